@@ -2,6 +2,7 @@ package action
 
 import (
 	"github.com/coyove/iis/dal"
+	"github.com/coyove/iis/model"
 	"github.com/gin-gonic/gin"
 )
 
@@ -46,19 +47,28 @@ func APIModKV(g *gin.Context) {
 		return
 	}
 
-	if g.PostForm("method") == "set" {
+	switch g.PostForm("method") {
+	case "set":
 		err := dal.ModKV().Set(g.PostForm("key"), []byte(g.PostForm("value")))
 		if err != nil {
 			g.String(200, err.Error())
 		} else {
 			g.String(200, "ok")
 		}
-	} else {
+	case "delete":
+		err := dal.ModKV().Delete(g.PostForm("key"))
+		if err != nil {
+			g.String(200, err.Error())
+		} else {
+			g.String(200, "ok")
+		}
+	default:
 		v, err := dal.ModKV().Get(g.PostForm("key"))
 		if err != nil {
 			g.String(200, err.Error())
 		} else {
-			g.String(200, "ok:"+string(v))
+			// Binary articles and users are shown as JSON, which can still be read after being saved back
+			g.String(200, "ok:"+string(model.ToJSON(v)))
 		}
 	}
 }
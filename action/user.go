@@ -56,7 +56,7 @@ func APISignup(g *gin.Context) {
 	u.DataIP = "{" + ip + "}"
 	u.TSignup = uint32(time.Now().Unix())
 	u.TLogin = uint32(time.Now().Unix())
-	tok := ik.MakeUserToken(u)
+	tok := ik.MakeUserToken(u.ID, u.Session)
 
 	if err := dal.Do(dal.NewRequest(dal.DoUpdateUser,
 		"ID", u.ID,
@@ -104,7 +104,7 @@ func APILogin(g *gin.Context) {
 		u.DataIP = strings.Join(ips, ",")
 	}
 
-	tok := ik.MakeUserToken(u)
+	tok := ik.MakeUserToken(u.ID, u.Session)
 
 	if err := dal.Do(dal.NewRequest(dal.DoUpdateUser,
 		"ID", u.ID,
@@ -200,7 +200,7 @@ func APILogout(g *gin.Context) {
 			"Session", genSession(),
 		))
 		u = &model.User{}
-		g.SetCookie("id", ik.MakeUserToken(u), 365*86400, "", "", false, false)
+		g.SetCookie("id", ik.MakeUserToken(u.ID, u.Session), 365*86400, "", "", false, false)
 	}
 	g.Status(200)
 }
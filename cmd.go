@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coyove/iis/common"
+	"github.com/coyove/iis/dal"
+	"github.com/coyove/iis/dal/backup"
+)
+
+const cmdUsage = `Commands:
+  iis backup [-since 2006-01-02T15:04:05Z] [-o file.tar.gz]   export the configured storage, -since needs FeedLog
+  iis restore file.tar.gz                                     verify then import an archive into the configured storage
+  iis verify file.tar.gz                                      check an archive against its manifest
+  iis migrate [-list]                                         run or list pending migrations
+  iis fsck [-repair]                                          check chains and counters, fix them with -repair
+  iis rebalance [-dry]                                        move keys to their shards after Shards has changed
+  iis archive [-age days]                                     move old articles into segments under ColdDir
+  iis backfill [-overwrite]                                   copy keys missing in the Mirror backend, offline
+  iis vacuum                                                  delete orphaned chunks of large values`
+
+// readOnlyCommand tells whether the command only reads the storage, see dal.ReadOnly
+func readOnlyCommand(args []string) bool {
+	has := func(name string) bool {
+		for _, a := range args[1:] {
+			if a = strings.TrimLeft(a, "-"); a == name || a == name+"=true" {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch args[0] {
+	case "backup", "verify":
+		return true
+	case "migrate":
+		return has("list")
+	case "fsck":
+		return !has("repair")
+	case "rebalance":
+		return has("dry")
+	}
+	return false
+}
+
+// runCommand runs maintenance commands against the configured storage
+func runCommand(args []string) {
+	var m *backup.Manifest
+	var err error
+
+	switch args[0] {
+	case "migrate":
+		fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+		list := fs.Bool("list", false, "list pending migrations only")
+		fs.Parse(args[1:])
+		if *list {
+			pending, err := dal.PendingMigrations()
+			if err != nil {
+				log.Fatal("[migrate] ", err)
+			}
+			log.Println("[migrate] pending:", pending)
+		} else if err := dal.Migrate(); err != nil {
+			log.Fatal("[migrate] ", err)
+		}
+		return
+	case "fsck":
+		fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+		repair := fs.Bool("repair", false, "fix issues")
+		fs.Parse(args[1:])
+		r, err := dal.Fsck(*repair)
+		if err != nil {
+			log.Fatal("[fsck] ", err)
+		}
+		fixed := 0
+		for _, i := range r.Issues {
+			if i.Fixed {
+				fixed++
+			}
+		}
+		log.Printf("[fsck] %d articles, %d users, %d chains, %d issues, %d fixed", r.Articles, r.Users, r.Chains, len(r.Issues), fixed)
+		return
+	case "rebalance":
+		fs := flag.NewFlagSet("rebalance", flag.ExitOnError)
+		dry := fs.Bool("dry", false, "count keys to move only")
+		fs.Parse(args[1:])
+		r, err := dal.Rebalance(*dry)
+		if err != nil {
+			log.Fatal("[rebalance] ", err)
+		}
+		for k, n := range r.Moved {
+			log.Printf("[rebalance] %s: %d", k, n)
+		}
+		log.Printf("[rebalance] %d keys scanned, dry run: %v", r.Scanned, *dry)
+		return
+	case "archive":
+		fs := flag.NewFlagSet("archive", flag.ExitOnError)
+		age := fs.Int("age", common.Cfg.ColdAge, "archive articles older than this, in days")
+		fs.Parse(args[1:])
+		if *age <= 0 {
+			log.Fatal("[archive] invalid age ", *age)
+		}
+		r, err := dal.Archive(time.Now().AddDate(0, 0, -*age))
+		if err != nil {
+			log.Fatal("[archive] ", err)
+		}
+		log.Printf("[archive] %d users, %d segments written, %d articles archived, %d skipped", r.Users, r.Segments, r.Archived, r.Skipped)
+		return
+	case "backfill":
+		fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+		overwrite := fs.Bool("overwrite", false, "also overwrite keys with different values")
+		fs.Parse(args[1:])
+		r, err := dal.Backfill(*overwrite)
+		if err != nil {
+			log.Fatal("[backfill] ", err)
+		}
+		log.Printf("[backfill] %d keys scanned, %d copied, %d fixed, %d mismatched", r.Scanned, r.Copied, r.Fixed, r.Mismatched)
+		return
+	case "vacuum":
+		scanned, deleted, err := dal.VacuumChunks()
+		if err != nil {
+			log.Fatal("[vacuum] ", err)
+		}
+		log.Printf("[vacuum] %d chunks scanned, %d deleted", scanned, deleted)
+		return
+	case "backup":
+		fs := flag.NewFlagSet("backup", flag.ExitOnError)
+		since := fs.String("since", "", "incremental export since the given time (RFC3339)")
+		out := fs.String("o", "iis-"+time.Now().Format("20060102-150405")+".tar.gz", "output file")
+		fs.Parse(args[1:])
+		m, err = runBackup(*out, *since)
+	case "restore", "verify":
+		if len(args) != 2 {
+			log.Fatal(cmdUsage)
+		}
+		if args[0] == "restore" {
+			m, err = backup.Restore(dal.ModKV(), args[1])
+		} else {
+			m, err = backup.Verify(args[1])
+		}
+	default:
+		log.Fatal(cmdUsage)
+	}
+
+	if err != nil {
+		log.Fatal("[", args[0], "] ", err)
+	}
+	log.Printf("[%s] done, %d records in %d chunks, source: %q, created: %v", args[0], m.Records, len(m.Chunks), m.Source, m.Created)
+}
+
+func runBackup(path, since string) (*backup.Manifest, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var m *backup.Manifest
+	if since == "" {
+		m, err = backup.Export(dal.ModKV(), f, common.Cfg.Storage)
+	} else {
+		t, err2 := time.Parse(time.RFC3339, since)
+		if err2 != nil {
+			return nil, err2
+		}
+		if dal.Feed().Log() == nil {
+			return nil, fmt.Errorf("incremental backup needs FeedLog")
+		}
+		m, err = backup.ExportSince(dal.Feed().Log(), t, f, common.Cfg.Storage)
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return m, f.Sync()
+}
@@ -29,7 +29,24 @@ var Cfg = struct {
 	CwRegion       string   `yaml:"CwRegion"`
 	DyAccessKey    string   `yaml:"DyAccessKey"`
 	DySecretKey    string   `yaml:"DySecretKey"`
+	DyTable        string   `yaml:"DyTable"`       // default: iis
+	DyEndpoint     string   `yaml:"DyEndpoint"`    // e.g. http://127.0.0.1:8000 for DynamoDB Local
+	DyTimeout      int      `yaml:"DyTimeout"`     // millisecond, of HTTP requests, default: 1000
+	DyMaxConns     int      `yaml:"DyMaxConns"`    // default: 200
+	DyRetries      int      `yaml:"DyRetries"`     // default: 5, backoff between retries is 50ms ~ 2s
+	DyCreateTable  bool     `yaml:"DyCreateTable"` // create the table if it doesn't exist
 	RedisAddr      string   `yaml:"RedisAddr"`
+	RedisVolatile  bool     `yaml:"RedisVolatile"`  // allow Storage: redis without AOF
+	Storage        string   `yaml:"Storage"`        // engine[:arg], e.g. log:tmp/iis.db
+	StorageFault   string   `yaml:"StorageFault"`   // e.g. error=0.01,latency=50ms-100ms, overridden by env KV_FAULT
+	Shards         []string `yaml:"Shards"`         // NN]name=spec, e.g. 50]a=disk:tmp/data1, overrides Storage, see kv.ShardKV
+	Mirror         string   `yaml:"Mirror"`         // spec of the secondary backend receiving every write, see kv.MirrorKV
+	MirrorShadow   float64  `yaml:"MirrorShadow"`   // ratio of reads compared with the secondary, e.g. 0.01
+	MirrorBackfill bool     `yaml:"MirrorBackfill"` // copy missing keys to Mirror in the background at startup
+	FeedLog        string   `yaml:"FeedLog"`        // directory of the durable change feed, e.g. tmp/feed
+	MetricsKey     string   `yaml:"MetricsKey"`     // required by /metrics unless requested from loopback
+	ColdDir        string   `yaml:"ColdDir"`        // directory of archived segments, e.g. tmp/cold
+	ColdAge        int      `yaml:"ColdAge"`        // day, articles older than this are archived by 'iis archive'
 
 	// inited after common.being read
 	Blk               cipher.Block
@@ -48,6 +65,7 @@ var Cfg = struct {
 	Cooldown:       5,
 	MaxMentions:    3,
 	MaxImagesCache: 10,
+	ColdAge:        365,
 }
 
 func MustLoadConfig() {
@@ -0,0 +1,8 @@
+package common
+
+import "os"
+
+// LockFile doesn't lock on Windows, only one process should open the storage
+func LockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+}
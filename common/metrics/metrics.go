@@ -0,0 +1,278 @@
+// Package metrics implements counters, gauges and histograms in Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefBuckets are latency buckets in seconds
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func init() {
+	NewGaugeFunc("go_goroutines", "Number of goroutines", func() float64 { return float64(runtime.NumGoroutine()) })
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	sync.Mutex
+	m map[string]collector
+}{m: map[string]collector{}}
+
+// register replaces the collector with the same name, so packages can be initialized more than once (tests)
+func register(name string, c collector) {
+	registry.Lock()
+	registry.m[name] = c
+	registry.Unlock()
+}
+
+// Write writes all metrics sorted by name
+func Write(w io.Writer) {
+	registry.Lock()
+	names := make([]string, 0, len(registry.m))
+	for name := range registry.m {
+		names = append(names, name)
+	}
+	cs := make([]collector, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		cs[i] = registry.m[name]
+	}
+	registry.Unlock()
+
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+func header(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString formats labels as {a="1",b="2"}, 'values' is the joined key of a vector
+func labelString(names []string, values string, extra ...string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, v := range strings.Split(values, "\xff") {
+			pairs = append(pairs, names[i]+`="`+labelEscaper.Replace(v)+`"`)
+		}
+	}
+	for i := 0; i < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func vectorKey(names []string, values []string) string {
+	if len(values) != len(names) {
+		panic(fmt.Sprintf("metrics: expect %d label values, got %d", len(names), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// Counter is a vector of values which only go up
+type Counter struct {
+	name, help string
+	labels     []string
+
+	mu     sync.RWMutex
+	values map[string]*uint64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: map[string]*uint64{}}
+	register(name, c)
+	return c
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) Add(n uint64, values ...string) {
+	k := vectorKey(c.labels, values)
+
+	c.mu.RLock()
+	p := c.values[k]
+	c.mu.RUnlock()
+
+	if p == nil {
+		c.mu.Lock()
+		if p = c.values[k]; p == nil {
+			p = new(uint64)
+			c.values[k] = p
+		}
+		c.mu.Unlock()
+	}
+	atomic.AddUint64(p, n)
+}
+
+func (c *Counter) write(w io.Writer) {
+	header(w, c.name, c.help, "counter")
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labelString(c.labels, k), atomic.LoadUint64(c.values[k]))
+	}
+}
+
+// Gauge is a vector of values which go up and down
+type Gauge struct {
+	name, help string
+	labels     []string
+
+	mu     sync.RWMutex
+	values map[string]*int64
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{name: name, help: help, labels: labels, values: map[string]*int64{}}
+	register(name, g)
+	return g
+}
+
+func (g *Gauge) Add(n int64, values ...string) {
+	k := vectorKey(g.labels, values)
+
+	g.mu.RLock()
+	p := g.values[k]
+	g.mu.RUnlock()
+
+	if p == nil {
+		g.mu.Lock()
+		if p = g.values[k]; p == nil {
+			p = new(int64)
+			g.values[k] = p
+		}
+		g.mu.Unlock()
+	}
+	atomic.AddInt64(p, n)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	header(w, g.name, g.help, "gauge")
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	keys := make([]string, 0, len(g.values))
+	for k := range g.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", g.name, labelString(g.labels, k), atomic.LoadInt64(g.values[k]))
+	}
+}
+
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is read from 'fn' on every scrape
+func NewGaugeFunc(name, help string, fn func() float64) {
+	register(name, &gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	header(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+type histogram struct {
+	counts []uint64 // not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Histogram is a vector of observations counted into buckets, 'buckets' must be sorted
+type Histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+	register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	k := vectorKey(h.labels, values)
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	x := h.values[k]
+	if x == nil {
+		x = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[k] = x
+	}
+	x.counts[i]++
+	x.sum += v
+	x.count++
+}
+
+// Since observes the seconds elapsed since 'start'
+func (h *Histogram) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	header(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		x, acc := h.values[k], uint64(0)
+		for i, c := range x.counts {
+			acc += c
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, k, "le", formatFloat(le)), acc)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, k), formatFloat(x.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, k), x.count)
+	}
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	c := NewCounter("test_total", "test", "a")
+	c.Inc("x")
+	c.Add(2, "y\"")
+	h := NewHistogram("test_seconds", "test", []float64{1, 2}, "a")
+	h.Observe(0.5, "x")
+	h.Observe(1.5, "x")
+	h.Observe(3, "x")
+
+	buf := &bytes.Buffer{}
+	Write(buf)
+	t.Log(buf.String())
+
+	for _, line := range []string{
+		`test_total{a="x"} 1`,
+		`test_total{a="y\""} 2`,
+		`test_seconds_bucket{a="x",le="1"} 1`,
+		`test_seconds_bucket{a="x",le="2"} 2`,
+		`test_seconds_bucket{a="x",le="+Inf"} 3`,
+		`test_seconds_sum{a="x"} 5`,
+		`test_seconds_count{a="x"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatal("missing:", line)
+		}
+	}
+}
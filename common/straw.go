@@ -13,15 +13,28 @@ func StrawWeight(v string) float64 {
 	return float64(v[0]-'0')*10 + float64(v[1]-'0')
 }
 
+// Draw picks a candidate for 'v' by weighted rendezvous hashing: each candidate draws a straw
+// of length ln(hash(v, name)) / weight and the longest wins. Adding a candidate or changing a weight
+// only moves values to or from that candidate. The weight prefix is not hashed, candidates with weight 0
+// are never picked.
 func Draw(v string, cands []string) (cand string) {
-	if len(cands) == 0 {
-		return ""
-	}
-
-	max := -math.MaxFloat64
+	max := math.Inf(-1)
 
 	for _, n := range cands {
-		s := math.Log(float64(Hash16(n))/65536) / StrawWeight(n)
+		name := n
+		if len(n) >= 3 && n[2] == ']' {
+			name = n[3:]
+		}
+
+		// FNV alone doesn't mix the last bytes well, finalize it like murmur3
+		h := Hash32(name + "\x00" + v)
+		h ^= h >> 16
+		h *= 0x85ebca6b
+		h ^= h >> 13
+		h *= 0xc2b2ae35
+		h ^= h >> 16
+		u := (float64(h) + 1) / (math.MaxUint32 + 2) // (0, 1)
+		s := math.Log(u) / StrawWeight(n)
 
 		if s > max {
 			max = s
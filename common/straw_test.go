@@ -17,6 +17,30 @@ func TestDraw(t *testing.T) {
 	}
 
 	t.Log(m)
+
+	// Weights
+	cands := []string{"20]a", "40]b", "40]c"}
+	res := map[string]int{}
+	for i := 0; i < 1e5; i++ {
+		res[Draw(strconv.Itoa(i), cands)]++
+	}
+	t.Log(res)
+	if res["20]a"] < 15000 || res["20]a"] > 25000 || res["40]b"] < 35000 || res["40]c"] < 35000 {
+		t.Fatal(res)
+	}
+
+	// Adding a candidate only moves values to it
+	cands2 := append(cands, "50]d")
+	for i := 0; i < 1e4; i++ {
+		k := strconv.Itoa(i)
+		if a, b := Draw(k, cands), Draw(k, cands2); a != b && b != "50]d" {
+			t.Fatal(k, a, b)
+		}
+	}
+
+	if Draw("aa", []string{"00]a"}) != "" {
+		t.Fatal("weight 0 should never be picked")
+	}
 }
 
 func BenchmarkDraw(b *testing.B) {
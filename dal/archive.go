@@ -0,0 +1,147 @@
+package dal
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/coyove/iis/dal/kv"
+	"github.com/coyove/iis/ik"
+	"github.com/coyove/iis/model"
+)
+
+var (
+	errNoColdDir  = fmt.Errorf("ColdDir is not set")
+	errColdVerify = fmt.Errorf("failed to verify the new segment")
+)
+
+// coldMonth returns the month of the segment which may hold the key, "" if the key is never archived
+func coldMonth(key string) string {
+	id := ik.ParseID(key)
+	if id.Header() != ik.IDGeneral || id.IsRoot() || id.String() != key {
+		return ""
+	}
+	return id.Time().UTC().Format("2006-01")
+}
+
+// getCold looks up archived records, it returns nil if ColdDir is not set or the key is not archived
+func getCold(key string) ([]byte, error) {
+	month := coldMonth(key)
+	if m.cold == nil || month == "" {
+		return nil, nil
+	}
+	p, err := m.cold.Get(month, key)
+	if err != nil {
+		log.Println("[mgr.getCold]", key, err)
+	}
+	return p, err
+}
+
+type ArchiveReport struct {
+	Users    int
+	Segments int
+	Archived int
+	Skipped  int // changed during archiving, kept in the hot storage
+}
+
+// Archive moves articles in author timelines created before 'before' into cold segments, then deletes them
+// from the hot storage. Archived articles are still readable by GetArticle, and writing to one brings it back
+// (see getArticleForUpdate). Deletions skip the change feed, the articles are not gone.
+func Archive(before time.Time) (*ArchiveReport, error) {
+	r := &ArchiveReport{}
+	if m.cold == nil {
+		return r, errNoColdDir
+	}
+
+	users := []string{}
+	if err := scanAll("u/", func(p kv.Pair) error {
+		if isUserKey(p.Key) {
+			users = append(users, p.Key[2:])
+		}
+		return nil
+	}); err != nil {
+		return r, err
+	}
+
+	for _, u := range users {
+		if err := archiveUser(u, before, r); err != nil {
+			return r, err
+		}
+		r.Users++
+	}
+	log.Printf("[Archive] %+v", *r)
+	return r, nil
+}
+
+func archiveUser(user string, before time.Time, r *ArchiveReport) error {
+	root, err := m.hot.Get(ik.NewID(ik.IDAuthor, user).String())
+	if err != nil || len(root) == 0 {
+		return err
+	}
+	a, err := model.UnmarshalArticle(root)
+	if err != nil {
+		return nil
+	}
+
+	type record struct {
+		kv.Pair
+		ver uint64
+	}
+	months := map[string][]record{}
+	visited := map[string]bool{}
+
+	// The chain goes from the newest to the oldest, it ends where the last run stopped
+	for next := a.NextID; next != "" && !visited[next]; {
+		visited[next] = true
+		p, ver, err := m.hot.GetWithVersion(next)
+		if err != nil {
+			return err
+		}
+		if len(p) == 0 {
+			break
+		}
+		a, err := model.UnmarshalArticle(p)
+		if err != nil {
+			return err
+		}
+		if month := coldMonth(next); month != "" && ik.ParseID(next).Time().Before(before) {
+			months[month] = append(months[month], record{kv.Pair{Key: next, Value: p}, ver})
+		}
+		next = a.NextID
+	}
+
+	for month, recs := range months {
+		pairs := make([]kv.Pair, len(recs))
+		for i, rec := range recs {
+			pairs[i] = rec.Pair
+		}
+		path, err := m.cold.Write(month, user, pairs)
+		if err != nil {
+			return err
+		}
+		r.Segments++
+
+		// The segment must be readable before anything is deleted
+		for _, rec := range recs {
+			if v, err := m.cold.Get(month, rec.Key); err != nil || !bytes.Equal(v, rec.Value) {
+				log.Println("[Archive] failed to verify", path, rec.Key, err)
+				return errColdVerify
+			}
+		}
+
+		// Records written since they were read are kept, the version is checked by the delete itself
+		for _, rec := range recs {
+			err := m.hot.CompareAndDelete(rec.Key, rec.ver)
+			if err == kv.ErrConflict {
+				r.Skipped++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			r.Archived++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+// Package backup moves data between storage backends using portable archives.
+//
+// An archive is a tar.gz containing chunks of records followed by manifest.json, which lists
+// the SHA256 of every chunk. Record layout in chunks:
+//
+//	flags (1) | keylen (uvarint) | key | vallen (uvarint) | value
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/coyove/iis/dal/feed"
+	"github.com/coyove/iis/dal/kv"
+)
+
+const (
+	manifestName    = "manifest.json"
+	manifestVersion = 1
+
+	chunkRecords = 10000
+	chunkBytes   = 16 << 20
+
+	recDelete = 1 << 0
+)
+
+type Chunk struct {
+	Name    string
+	Records int
+	SHA256  string
+}
+
+type Manifest struct {
+	Version int
+	Source  string
+	Created time.Time // when the export started, use it as 'since' of the next incremental export
+	Since   time.Time `json:",omitempty"` // zero for full exports
+	Records int
+	Chunks  []Chunk
+}
+
+// Record is a key/value pair, incremental exports also contain deletions
+type Record struct {
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+type Writer struct {
+	gz  *gzip.Writer
+	tw  *tar.Writer
+	buf bytes.Buffer
+	n   int
+	m   *Manifest
+}
+
+func NewWriter(w io.Writer, m *Manifest) *Writer {
+	gz := gzip.NewWriter(w)
+	m.Version = manifestVersion
+	return &Writer{
+		gz: gz,
+		tw: tar.NewWriter(gz),
+		m:  m,
+	}
+}
+
+func (w *Writer) Write(r Record) error {
+	var tmp [binary.MaxVarintLen64]byte
+	if r.Deleted {
+		w.buf.WriteByte(recDelete)
+	} else {
+		w.buf.WriteByte(0)
+	}
+	w.buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(r.Key)))])
+	w.buf.WriteString(r.Key)
+	w.buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(r.Value)))])
+	w.buf.Write(r.Value)
+
+	w.n++
+	if w.n >= chunkRecords || w.buf.Len() >= chunkBytes {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *Writer) writeFile(name string, p []byte) error {
+	if err := w.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(p)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(p)
+	return err
+}
+
+func (w *Writer) flush() error {
+	if w.n == 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256(w.buf.Bytes())
+	c := Chunk{
+		Name:    fmt.Sprintf("chunk-%06d.kv", len(w.m.Chunks)),
+		Records: w.n,
+		SHA256:  hex.EncodeToString(sum[:]),
+	}
+	if err := w.writeFile(c.Name, w.buf.Bytes()); err != nil {
+		return err
+	}
+
+	w.m.Chunks = append(w.m.Chunks, c)
+	w.m.Records += w.n
+	w.buf.Reset()
+	w.n = 0
+	return nil
+}
+
+// Close writes the manifest and finishes the archive, it doesn't close the underlying writer
+func (w *Writer) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	p, _ := json.MarshalIndent(w.m, "", "  ")
+	if err := w.writeFile(manifestName, p); err != nil {
+		return err
+	}
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// Export writes every key in 'db' to 'w'. The store is not frozen during the export,
+// writes after Manifest.Created may or may not be included, an incremental export since then will cover them.
+func Export(db kv.KeyValueOp, w io.Writer, source string) (*Manifest, error) {
+	m := &Manifest{Source: source, Created: time.Now()}
+	aw := NewWriter(w, m)
+
+	for cursor := ""; ; {
+		res, next, err := db.Scan("", cursor, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range res {
+			if err := aw.Write(Record{Key: p.Key, Value: p.Value}); err != nil {
+				return nil, err
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return m, aw.Close()
+}
+
+// ExportSince writes every change in the feed log since 'since' to 'w' in order,
+// a key may appear more than once and the last one wins when restoring.
+func ExportSince(l *feed.Log, since time.Time, w io.Writer, source string) (*Manifest, error) {
+	m := &Manifest{Source: source, Created: time.Now(), Since: since}
+	end := l.End()
+
+	offset := l.Start()
+	if offset > 0 {
+		// Older events have been truncated, make sure none of them is needed
+		res, err := l.Read(offset, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) > 0 && res[0].Time > since.UnixNano() {
+			return nil, fmt.Errorf("feed log starts at %v, after %v", time.Unix(0, res[0].Time), since)
+		}
+	}
+
+	aw := NewWriter(w, m)
+	for offset < end {
+		res, err := l.Read(offset, 1000)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) == 0 {
+			break
+		}
+		for _, e := range res {
+			if e.Offset > end {
+				break
+			}
+			if e.Time < since.UnixNano() {
+				continue
+			}
+			if err := aw.Write(Record{Key: e.Key, Value: e.Value, Deleted: e.Deleted}); err != nil {
+				return nil, err
+			}
+		}
+		offset = res[len(res)-1].Offset
+	}
+	return m, aw.Close()
+}
+
+func readRecords(p []byte, fn func(Record) error) (n int, err error) {
+	for len(p) > 0 {
+		r := Record{Deleted: p[0]&recDelete != 0}
+		p = p[1:]
+
+		var fields [2][]byte
+		for i := range fields {
+			ln, sz := binary.Uvarint(p)
+			if sz <= 0 || uint64(len(p)-sz) < ln {
+				return n, fmt.Errorf("invalid record #%d", n)
+			}
+			fields[i] = p[sz : sz+int(ln)]
+			p = p[sz+int(ln):]
+		}
+
+		r.Key, r.Value = string(fields[0]), fields[1]
+		if r.Deleted {
+			r.Value = nil
+		}
+		if fn != nil {
+			if err := fn(r); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// walk reads the archive at 'path' and calls 'fn' for every record, verification only happens when 'fn' is nil
+func walk(path string, fn func(Record) error) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+
+	var m *Manifest
+	sums := map[string]Chunk{}
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Name == manifestName {
+			m = &Manifest{}
+			if err := json.Unmarshal(p, m); err != nil {
+				return nil, fmt.Errorf("manifest: %v", err)
+			}
+			continue
+		}
+
+		sum := sha256.Sum256(p)
+		c := Chunk{Name: hdr.Name, SHA256: hex.EncodeToString(sum[:])}
+		if c.Records, err = readRecords(p, fn); err != nil {
+			return nil, fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		sums[hdr.Name] = c
+	}
+
+	if m == nil {
+		return nil, fmt.Errorf("manifest not found")
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("unknown archive version: %d", m.Version)
+	}
+	if len(sums) != len(m.Chunks) {
+		return nil, fmt.Errorf("%d chunks found, manifest says %d", len(sums), len(m.Chunks))
+	}
+	for _, c := range m.Chunks {
+		if sums[c.Name] != c {
+			return nil, fmt.Errorf("%s: mismatched chunk, manifest: %+v, actual: %+v", c.Name, c, sums[c.Name])
+		}
+	}
+	return m, nil
+}
+
+// Verify checks every chunk of the archive against the manifest
+func Verify(path string) (*Manifest, error) {
+	return walk(path, nil)
+}
+
+// Restore verifies the archive then writes all records into 'db', keys not in the archive are left untouched
+func Restore(db kv.KeyValueOp, path string) (*Manifest, error) {
+	if _, err := Verify(path); err != nil {
+		return nil, err
+	}
+	return walk(path, func(r Record) error {
+		if r.Deleted {
+			return db.Delete(r.Key)
+		}
+		return db.Set(r.Key, r.Value)
+	})
+}
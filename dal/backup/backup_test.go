@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coyove/iis/dal/feed"
+	"github.com/coyove/iis/dal/kv"
+)
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, _ := kv.NewMemoryKV("")
+	for i := 0; i < chunkRecords*2+10; i++ {
+		src.Set(strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+
+	path := filepath.Join(dir, "full.tar.gz")
+	f, _ := os.Create(path)
+	m, err := Export(src, f, "memory")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Records != chunkRecords*2+10 || len(m.Chunks) != 3 {
+		t.Fatal(m)
+	}
+
+	dst, _ := kv.NewMemoryKV("")
+	if _, err := Restore(dst, path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < m.Records; i++ {
+		if v, _ := dst.Get(strconv.Itoa(i)); string(v) != strconv.Itoa(i) {
+			t.Fatal(i, string(v))
+		}
+	}
+
+	// Incremental
+	l, err := feed.OpenLog(filepath.Join(dir, "feed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Publish(&feed.Event{Key: "0", Value: []byte("old"), Time: m.Created.Add(-time.Second).UnixNano()})
+	l.Publish(&feed.Event{Key: "1", Value: []byte("new"), Time: m.Created.UnixNano()})
+	l.Publish(&feed.Event{Key: "2", Deleted: true, Time: m.Created.UnixNano()})
+
+	ipath := filepath.Join(dir, "inc.tar.gz")
+	f, _ = os.Create(ipath)
+	im, err := ExportSince(l, m.Created, f, "memory")
+	f.Close()
+	if err != nil || im.Records != 2 {
+		t.Fatal(im, err)
+	}
+	if _, err := Restore(dst, ipath); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := dst.Get("0"); string(v) != "0" {
+		t.Fatal(string(v))
+	}
+	if v, _ := dst.Get("1"); string(v) != "new" {
+		t.Fatal(string(v))
+	}
+	if v, _ := dst.Get("2"); v != nil {
+		t.Fatal(string(v))
+	}
+
+	// Corruption
+	var buf bytes.Buffer
+	aw := NewWriter(&buf, &Manifest{})
+	aw.Write(Record{Key: "a", Value: []byte("a")})
+	aw.m.Chunks = append(aw.m.Chunks, Chunk{Name: "missing"})
+	aw.Close()
+	ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if _, err := Verify(path); err == nil {
+		t.Fatal("should fail")
+	} else {
+		t.Log(err)
+	}
+}
@@ -0,0 +1,319 @@
+// Package cold stores old records in immutable, compressed segment files, one per user and month
+package cold
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/iis/dal/kv"
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+// Segment layout:
+//
+//	magic (4) | uvarint n | n * (uvarint keylen | key) | flate(n * (uvarint vallen | value)) | crc32 (4, big endian)
+//
+// crc32 covers everything before it. Segments live in <dir>/<2006-01>/<user>.<unix nano>.seg,
+// the month is the month of the record IDs, so a lookup only reads the segments of one month.
+// Each segment has a key index next to it, <user>.<unix nano>.idx:
+//
+//	magic (4) | uvarint n | n * (uvarint keylen | key) | crc32 (4, big endian)
+var (
+	segMagic = []byte("ISG1")
+	idxMagic = []byte("IIX1")
+)
+
+const (
+	segExt = ".seg"
+	idxExt = ".idx"
+)
+
+var ErrCorrupted = fmt.Errorf("cold: corrupted segment")
+
+type monthIndex struct {
+	mtime  time.Time
+	loaded time.Time
+	keys   map[string]string // key -> segment path
+}
+
+type Store struct {
+	dir string
+
+	mu     sync.Mutex
+	months map[string]*monthIndex
+	writes int // indexes loaded before a Write are dropped
+
+	segments *cache.ShardedCache // segment path -> map[string][]byte
+}
+
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &Store{
+		dir:      dir,
+		months:   map[string]*monthIndex{},
+		segments: cache.NewShardedCache(256, 10*time.Minute, 16),
+	}, nil
+}
+
+// Get returns nil if the key is not archived in the month
+func (s *Store) Get(month, key string) ([]byte, error) {
+	path, err := s.lookup(month, key)
+	if path == "" || err != nil {
+		return nil, err
+	}
+
+	if v, ok := s.segments.Get(path); ok {
+		return v.(map[string][]byte)[key], nil
+	}
+
+	_, values, err := readSegment(path, true)
+	if err != nil {
+		return nil, err
+	}
+	s.segments.Add(path, values)
+	return values[key], nil
+}
+
+// lookup finds the segment of the key, the index of the month is reloaded when segments are added.
+// Indexes are loaded without holding the lock.
+func (s *Store) lookup(month, key string) (string, error) {
+	s.mu.Lock()
+	idx, writes := s.months[month], s.writes
+	s.mu.Unlock()
+
+	if idx != nil {
+		if path, ok := idx.keys[key]; ok {
+			return path, nil
+		}
+	}
+
+	dir := filepath.Join(s.dir, month)
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	// mtime is coarse, a segment renamed right after the index was loaded may keep it unchanged
+	if idx != nil && fi.ModTime().Equal(idx.mtime) && idx.loaded.Sub(idx.mtime) > time.Second {
+		return "", nil
+	}
+
+	idx, err = loadMonth(dir, fi.ModTime())
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	if s.writes == writes {
+		s.months[month] = idx
+	}
+	s.mu.Unlock()
+	return idx.keys[key], nil
+}
+
+func loadMonth(dir string, mtime time.Time) (*monthIndex, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segExt))
+	if err != nil {
+		return nil, err
+	}
+	idx := &monthIndex{mtime: mtime, loaded: time.Now(), keys: map[string]string{}}
+	// Glob sorts names, which end with the creation time, so newer segments of a user win
+	for _, path := range names {
+		keys, err := readIndex(indexPath(path))
+		if err != nil {
+			// Missing or broken index, the segment has the keys too
+			if keys, _, err = readSegment(path, false); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		}
+		for _, k := range keys {
+			idx.keys[k] = path
+		}
+	}
+	return idx, nil
+}
+
+func indexPath(segment string) string {
+	return strings.TrimSuffix(segment, segExt) + idxExt
+}
+
+func appendKeys(buf *bytes.Buffer, magic []byte, pairs []kv.Pair) {
+	buf.Write(magic)
+	writeUvarint(buf, uint64(len(pairs)))
+	for _, p := range pairs {
+		writeUvarint(buf, uint64(len(p.Key)))
+		buf.WriteString(p.Key)
+	}
+}
+
+// Write packs the pairs into a new segment, the index then the segment are fsync-ed and renamed into place
+// before returning, so every segment found by lookups has its index
+func (s *Store) Write(month, user string, pairs []kv.Pair) (string, error) {
+	dir := filepath.Join(s.dir, month)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	appendKeys(buf, segMagic, pairs)
+
+	w, _ := flate.NewWriter(buf, flate.BestCompression)
+	for _, p := range pairs {
+		writeUvarint(w, uint64(len(p.Value)))
+		w.Write(p.Value)
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	ibuf := &bytes.Buffer{}
+	appendKeys(ibuf, idxMagic, pairs)
+	binary.Write(ibuf, binary.BigEndian, crc32.ChecksumIEEE(ibuf.Bytes()))
+
+	path := filepath.Join(dir, url.PathEscape(user)+"."+strconv.FormatInt(time.Now().UnixNano(), 10)+segExt)
+	if err := writeFile(dir, indexPath(path), ibuf.Bytes()); err != nil {
+		return "", err
+	}
+	if err := writeFile(dir, path, buf.Bytes()); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	delete(s.months, month)
+	s.writes++
+	s.mu.Unlock()
+	return path, nil
+}
+
+func writeFile(dir, path string, p []byte) error {
+	f, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(p); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readIndex verifies the checksum of the key index and returns the keys
+func readIndex(path string) ([]string, error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) < len(idxMagic)+4 || !bytes.HasPrefix(p, idxMagic) {
+		return nil, ErrCorrupted
+	}
+	body, sum := p[:len(p)-4], binary.BigEndian.Uint32(p[len(p)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, ErrCorrupted
+	}
+	keys, err := readKeys(bytes.NewReader(body[len(idxMagic):]), len(body))
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return keys, nil
+}
+
+func readKeys(rd *bytes.Reader, max int) ([]string, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil || n > uint64(max) {
+		return nil, ErrCorrupted
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		k, err := readBytes(rd)
+		if err != nil {
+			return nil, ErrCorrupted
+		}
+		keys[i] = string(k)
+	}
+	return keys, nil
+}
+
+// readSegment verifies the checksum and returns the keys, values are decoded only if asked
+func readSegment(path string, withValues bool) ([]string, map[string][]byte, error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(p) < len(segMagic)+4 || !bytes.HasPrefix(p, segMagic) {
+		return nil, nil, ErrCorrupted
+	}
+	body, sum := p[:len(p)-4], binary.BigEndian.Uint32(p[len(p)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, nil, ErrCorrupted
+	}
+
+	rd := bytes.NewReader(body[len(segMagic):])
+	keys, err := readKeys(rd, len(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !withValues {
+		return keys, nil, nil
+	}
+
+	fr := flate.NewReader(rd)
+	defer fr.Close()
+	br := bufio.NewReader(fr)
+	values := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		v, err := readBytes(br)
+		if err != nil {
+			return nil, nil, ErrCorrupted
+		}
+		values[k] = v
+	}
+	return keys, values, nil
+}
+
+func writeUvarint(w io.Writer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	w.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readBytes(rd byteReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<30 {
+		return nil, ErrCorrupted
+	}
+	p := make([]byte, n)
+	_, err = io.ReadFull(rd, p)
+	return p, err
+}
@@ -0,0 +1,67 @@
+package cold
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/coyove/iis/dal/kv"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, _ := Open(dir)
+	pairs := []kv.Pair{}
+	for i := 0; i < 100; i++ {
+		pairs = append(pairs, kv.Pair{Key: "k" + strconv.Itoa(i), Value: []byte("value" + strconv.Itoa(i))})
+	}
+	path, err := s.Write("2020-01", "a/b", pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(path)
+
+	if v, err := s.Get("2020-01", "k42"); err != nil || string(v) != "value42" {
+		t.Fatal(string(v), err)
+	}
+	if v, err := s.Get("2020-02", "k42"); err != nil || v != nil {
+		t.Fatal(string(v), err)
+	}
+
+	// A newer segment of the same month is picked up, and wins
+	if _, err := s.Write("2020-01", "c", []kv.Pair{{Key: "k1", Value: []byte("new")}, {Key: "x", Value: []byte("x")}}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("2020-01", "x"); string(v) != "x" {
+		t.Fatal(string(v))
+	}
+
+	// Keys are loaded from the index, or from the segment if the index is gone
+	if keys, err := readIndex(indexPath(path)); err != nil || len(keys) != 100 {
+		t.Fatal(keys, err)
+	}
+	os.Remove(indexPath(path))
+	s, _ = Open(dir)
+	if v, err := s.Get("2020-01", "k42"); err != nil || string(v) != "value42" {
+		t.Fatal(string(v), err)
+	}
+
+	// Flip a byte, the checksum must catch it
+	p, _ := ioutil.ReadFile(path)
+	p[len(p)/2]++
+	ioutil.WriteFile(path, p, 0644)
+	if _, _, err := readSegment(path, true); err != ErrCorrupted {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "2020-01", "tmp*"))
+	if len(matches) != 0 {
+		t.Fatal(matches)
+	}
+}
@@ -2,16 +2,21 @@ package dal
 
 import (
 	"fmt"
+	"math/rand"
 	"reflect"
 	"time"
 
 	"github.com/coyove/iis/common"
+	"github.com/coyove/iis/dal/kv"
 	"github.com/coyove/iis/ik"
 	"github.com/coyove/iis/model"
 )
 
 var ErrInvalidRequest = fmt.Errorf("invalid request")
 
+// Requests are retried when another writer wins the compare-and-set
+const maxConflictRetries = 10
+
 const (
 	DoUpdateUser    string = "UpdateUser"
 	DoUpdateArticle        = "UpdateArticle"
@@ -20,23 +25,24 @@ const (
 
 type Request struct {
 	UpdateUserRequest *struct {
-		ID               string
-		ToggleMod        bool
-		ToggleBan        bool
-		Signup           bool
-		IncUnread        bool
-		IncDecFollowers  *bool
-		IncDecFollowings *bool
-		Session          *string
-		PasswordHash     *[]byte
-		Email            *string
-		Avatar           *uint32
-		CustomName       *string
-		Unread           *int32
-		DataIP           *string
-		TSignup          *uint32
-		TLogin           *uint32
-		Kimochi          *byte
+		ID                  string
+		ToggleMod           bool
+		ToggleBan           bool
+		Signup              bool
+		IncUnread           bool
+		ClearFollowingChain bool
+		IncDecFollowers     *bool
+		IncDecFollowings    *bool
+		Session             *string
+		PasswordHash        *[]byte
+		Email               *string
+		Avatar              *uint32
+		CustomName          *string
+		Unread              *int32
+		DataIP              *string
+		TSignup             *uint32
+		TLogin              *uint32
+		Kimochi             *byte
 
 		SettingAutoNSFW    *bool
 		SettingFoldImages  *bool
@@ -118,12 +124,15 @@ func coUpdateUser(r *Request) error {
 
 	updateUserSettings := func(id string, cb func(u *model.UserSettings) error) error {
 		sid := "u/" + id + "/settings"
-		p, _ := m.db.Get(sid)
+		p, ver, err := m.db.GetWithVersion(sid)
+		if err != nil {
+			return err
+		}
 		s := model.UnmarshalUserSettings(p)
 		if err := cb(&s); err != nil {
 			return err
 		}
-		return m.db.Set(sid, s.Marshal())
+		return m.db.CompareAndSet(sid, s.Marshal(), ver)
 	}
 
 	if rr.SettingAutoNSFW != nil {
@@ -145,7 +154,7 @@ func coUpdateUser(r *Request) error {
 		})
 	}
 
-	u, err := GetUser(id)
+	u, ver, err := getUserForUpdate(id)
 	if err == model.ErrNotExisted && rr.Signup {
 		u = &model.User{ID: id}
 		err = nil
@@ -183,6 +192,9 @@ func coUpdateUser(r *Request) error {
 	if rr.Kimochi != nil {
 		u.Kimochi = *rr.Kimochi
 	}
+	if rr.ClearFollowingChain {
+		u.FollowingChain = ""
+	}
 	if rr.Session != nil {
 		u.Session = *rr.Session
 	}
@@ -230,8 +242,8 @@ func coUpdateUser(r *Request) error {
 	if u.ID == "" {
 		return nil
 	}
-	m.weakUsers.Delete(u.ID)
-	return m.db.Set("u/"+u.ID, u.Marshal())
+	m.users.Delete(u.ID)
+	return m.db.CompareAndSet("u/"+u.ID, u.Marshal(), ver)
 }
 
 func coUpdateArticle(r *Request) error {
@@ -243,7 +255,7 @@ func coUpdateArticle(r *Request) error {
 	common.LockKey(rr.ID)
 	defer common.UnlockKey(rr.ID)
 
-	a, err := GetArticle(rr.ID)
+	a, ver, err := getArticleForUpdate(rr.ID)
 	if err != nil {
 		return err
 	}
@@ -263,6 +275,7 @@ func coUpdateArticle(r *Request) error {
 		if rr.DeleteBy.ID != a.Author && !rr.DeleteBy.IsMod() {
 			return fmt.Errorf("user/not-allowed")
 		}
+		// Not Delete, the article is still a node of its chains
 		a.Content = model.DeletionMarker
 		a.Media = ""
 	}
@@ -280,7 +293,7 @@ func coUpdateArticle(r *Request) error {
 	}
 	rr.Response.Article = *a
 
-	return m.db.Set(a.ID, a.Marshal())
+	return m.db.CompareAndSet(a.ID, a.Marshal(), ver)
 }
 
 func coInsertArticle(r *Request) error {
@@ -295,7 +308,7 @@ func coInsertArticle(r *Request) error {
 	common.LockKey(rootID)
 	defer common.UnlockKey(rootID)
 
-	root, err := GetArticle(rootID)
+	root, ver, err := getArticleForUpdate(rootID)
 	if err != nil && err != model.ErrNotExisted {
 		return err
 	}
@@ -311,18 +324,16 @@ func coInsertArticle(r *Request) error {
 		}
 	}
 
+	var checkpoint *model.Article
 	if x, y := ik.ParseID(rootID), ik.ParseID(root.NextID); x.Header() == ik.IDAuthor && y.Valid() {
 		now := time.Now()
 		if now.Year() != y.Time().Year() || now.Month() != y.Time().Month() {
 			// The very last article was made before this month, so we will create a checkpoint for long jmp
-			go func() {
-				a := &model.Article{
-					ID:         makeCheckpointID(x.Tag(), root.CreateTime),
-					ReferID:    root.NextID,
-					CreateTime: time.Now(),
-				}
-				m.db.Set(a.ID, a.Marshal())
-			}()
+			checkpoint = &model.Article{
+				ID:         makeCheckpointID(x.Tag(), root.CreateTime),
+				ReferID:    root.NextID,
+				CreateTime: now,
+			}
 		}
 	}
 
@@ -343,23 +354,78 @@ func coInsertArticle(r *Request) error {
 		return err
 	}
 
-	if err := m.db.Set(root.ID, root.Marshal()); err != nil {
+	if err := m.db.CompareAndSet(root.ID, root.Marshal(), ver); err != nil {
 		return err
 	}
 
+	// Written once the insert has won, conflicts are retried by Do
+	if checkpoint != nil {
+		goBackground("checkpoint", func() {
+			m.db.Set(checkpoint.ID, checkpoint.Marshal())
+		})
+	}
+
 	r.InsertArticleRequest.Response.Article = a
 	return nil
 }
 
+// getArticleForUpdate reads the article record along with its version,
+// if the record refers to another article, the referred one will be returned.
+// Archived articles are read with version 0, so CompareAndSet brings them back to the hot storage
+func getArticleForUpdate(id string) (*model.Article, uint64, error) {
+	p, ver, err := m.db.GetWithVersion(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(p) == 0 {
+		if p, err = getCold(id); err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(p) == 0 {
+		return nil, 0, model.ErrNotExisted
+	}
+	a, err := model.UnmarshalArticle(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	if a.ReferID != "" {
+		return getArticleForUpdate(a.ReferID)
+	}
+	return a, ver, nil
+}
+
+func getUserForUpdate(id string) (*model.User, uint64, error) {
+	p, ver, err := m.db.GetWithVersion("u/" + id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(p) == 0 {
+		return nil, 0, model.ErrNotExisted
+	}
+	u, err := model.UnmarshalUser(p)
+	return u, ver, err
+}
+
 func Do(r *Request) error {
+	var do func(*Request) error
+
 	switch {
 	case r.UpdateUserRequest != nil:
-		return coUpdateUser(r)
+		do = coUpdateUser
 	case r.UpdateArticleRequest != nil:
-		return coUpdateArticle(r)
+		do = coUpdateArticle
 	case r.InsertArticleRequest != nil:
-		return coInsertArticle(r)
+		do = coInsertArticle
 	default:
 		return nil
 	}
+
+	for i := 0; ; i++ {
+		err := do(r)
+		if err != kv.ErrConflict || i >= maxConflictRetries {
+			return err
+		}
+		time.Sleep(time.Duration(rand.Intn(10*(i+1))) * time.Millisecond)
+	}
 }
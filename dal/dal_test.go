@@ -1,15 +1,467 @@
 package dal
 
 import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/coyove/iis/common"
+	"github.com/coyove/iis/dal/cold"
+	"github.com/coyove/iis/dal/kv"
+	"github.com/coyove/iis/ik"
+	"github.com/coyove/iis/model"
 )
 
+// initMemory gives the test a fresh in-memory store, the returned func waits for background writes
+// and restores the previous state: defer initMemory()()
+func initMemory() func() {
+	old, storage := m, common.Cfg.Storage
+	common.Cfg.Storage = "memory"
+	Init(nil, "", "", "")
+	return func() {
+		background.Wait()
+		m, common.Cfg.Storage = old, storage
+	}
+}
+
 func TestNewRequest(t *testing.T) {
 	t.Log(*NewRequest("Test", "A", 1).TestRequest.A)
 }
 
+func TestPostAndWalk(t *testing.T) {
+	defer initMemory()()
+
+	if err := Do(NewRequest(DoUpdateUser, "ID", "alice", "Signup", true, "PasswordHash", []byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+	u, err := GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for i := 0; i < 10; i++ {
+		a, err := Post(&model.Article{Content: "post " + strconv.Itoa(i)}, u, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, a.ID)
+	}
+
+	res, next := WalkMulti(false, 5, ik.NewID(ik.IDAuthor, "alice"))
+	if len(res) != 5 || res[0].ID != ids[9] || res[4].ID != ids[5] {
+		t.Fatal(res)
+	}
+	res, _ = WalkMulti(false, 10, next...)
+	if len(res) != 5 || res[4].ID != ids[0] {
+		t.Fatal(res)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := PostReply(ids[0], "reply "+strconv.Itoa(i), "", u, "127.0.0.1", false, true); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	a, _ := GetArticle(ids[0])
+	replies, _ := WalkReply(100, a.ReplyChain)
+	if a.Replies != 20 || len(replies) != 20 {
+		t.Fatal(a.Replies, len(replies))
+	}
+}
+
 func BenchmarkNewRequest(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		NewRequest("UpdateUserKimochi", "ID", "zzz", "Kimochi", byte(12))
 	}
 }
+
+func TestMigrateBinaryCodec(t *testing.T) {
+	defer initMemory()()
+
+	m.db.Set("u/frank", []byte(`{"ID":"frank"}`))
+	m.db.Set("legacy2", []byte(`{"id":"legacy2"}`))
+	m.db.Set("other", []byte(`{"x":1}`))
+
+	for i := 0; i < 2; i++ {
+		if err := MigrateBinaryCodec(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"u/frank", "legacy2"} {
+		if p, _ := m.db.Get(k); len(p) == 0 || p[0] == '{' {
+			t.Fatal(k, string(p))
+		}
+	}
+	if p, _ := m.db.Get("other"); string(p) != `{"x":1}` {
+		t.Fatal(string(p))
+	}
+	if u, _ := GetUser("frank"); u == nil || u.ID != "frank" {
+		t.Fatal(u)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	defer initMemory()()
+
+	// Init has migrated the empty store already
+	if pending, _ := PendingMigrations(); len(pending) != 0 {
+		t.Fatal(pending)
+	}
+	for _, mg := range migrations {
+		m.db.Delete(migrationPrefix + mg.Name)
+	}
+
+	// Legacy: "bob" follows through an old article chain, "carol" has a broken one
+	m.db.Set("u/bob", []byte(`{"ID":"bob","FC2":"legacy1"}`))
+	m.db.Set("legacy1", []byte(`{"id":"legacy1","N":"u/bob/follow/1"}`))
+	m.db.Set("u/bob/follow/1", (&model.Article{ID: "u/bob/follow/1", Cmd: model.CmdFollow}).Marshal())
+	m.db.Set("u/carol", []byte(`{"ID":"carol","FC2":"missing"}`))
+	m.db.Set("u/carol/follow/1", (&model.Article{ID: "u/carol/follow/1", NextID: "x"}).Marshal())
+	m.db.Set("u/carol/follow/2", (&model.Article{ID: "u/carol/follow/2"}).Marshal())
+
+	for i := 0; i < 2; i++ {
+		if err := Migrate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending, _ := PendingMigrations(); len(pending) != 0 {
+		t.Fatal(pending)
+	}
+
+	if c := followingChain("bob"); len(c) != 1 || c[0] != "u/bob/follow/1" {
+		t.Fatal(c)
+	}
+	if c := followingChain("carol"); len(c) != 2 || c[0] != "u/carol/follow/1" || c[1] != "u/carol/follow/2" {
+		t.Fatal(c)
+	}
+
+	for _, k := range []string{"u/bob", "u/carol", "legacy1"} {
+		if p, _ := m.db.Get(k); len(p) == 0 || p[0] == '{' {
+			t.Fatal(k, string(p))
+		}
+	}
+	if u, _ := GetUser("bob"); u.FollowingChain != "" {
+		t.Fatal(u)
+	}
+}
+
+func followingChain(id string) (res []string) {
+	a, _ := GetArticle(ik.NewID(ik.IDFollowing, id).String())
+	for next := a.NextID; next != "" && len(res) < 100; {
+		res = append(res, next)
+		a, _ = GetArticle(next)
+		next = a.NextID
+	}
+	return
+}
+
+func TestMigrateExistingRoot(t *testing.T) {
+	defer initMemory()()
+
+	// Both followed someone after the chain was deprecated: "dave" has a broken legacy chain, "fay" an intact one
+	for _, id := range []string{"dave", "fay"} {
+		root := ik.NewID(ik.IDFollowing, id).String()
+		m.db.Set(root, (&model.Article{ID: root, NextID: "u/" + id + "/follow/3"}).Marshal())
+		m.db.Set("u/"+id+"/follow/3", (&model.Article{ID: "u/" + id + "/follow/3"}).Marshal())
+	}
+	m.db.Set("u/dave", []byte(`{"ID":"dave","FC2":"missing"}`))
+	m.db.Set("u/dave/follow/1", (&model.Article{ID: "u/dave/follow/1", NextID: "x"}).Marshal())
+	m.db.Set("u/dave/follow/2", (&model.Article{ID: "u/dave/follow/2"}).Marshal())
+	m.db.Set("u/fay", []byte(`{"ID":"fay","FC2":"legacy3"}`))
+	m.db.Set("legacy3", []byte(`{"id":"legacy3","N":"u/fay/follow/1"}`))
+	m.db.Set("u/fay/follow/1", (&model.Article{ID: "u/fay/follow/1"}).Marshal())
+
+	for i := 0; i < 2; i++ {
+		if err := migrateFollowingChain(); err != nil {
+			t.Fatal(err)
+		}
+		// Run again as if the user wasn't cleared
+		if err := migrateUserFollowingChain(&model.User{ID: "fay", FollowingChain: "legacy3"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c := followingChain("dave"); len(c) != 3 || c[0] != "u/dave/follow/3" || c[1] != "u/dave/follow/1" || c[2] != "u/dave/follow/2" {
+		t.Fatal(c)
+	}
+	if c := followingChain("fay"); len(c) != 2 || c[0] != "u/fay/follow/3" || c[1] != "u/fay/follow/1" {
+		t.Fatal(c)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	defer initMemory()()
+
+	if err := Do(NewRequest(DoUpdateUser, "ID", "dave", "Signup", true)); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := GetUser("dave")
+	a1, _ := Post(&model.Article{Content: "1"}, u, true)
+	a2, _ := Post(&model.Article{Content: "2"}, u, true)
+	PostReply(a1.ID, "r", "", u, "", false, true)
+	root := ik.NewID(ik.IDAuthor, "dave").String()
+
+	// Crash between writing the article and updating the root
+	orphan := &model.Article{ID: ik.NewGeneralID().String(), Author: "dave", NextID: a2.ID, CreateTime: time.Now()}
+	m.db.Set(orphan.ID, orphan.Marshal())
+	// Dangling reply chain and counter drift
+	updateArticleRaw(a2.ID, func(a *model.Article) { a.ReplyChain, a.Replies = "missing", 3 })
+	updateArticleRaw(a1.ID, func(a *model.Article) { a.NextID = a2.ID })
+
+	r, err := Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Issues) < 4 {
+		t.Fatal(r.Issues)
+	}
+
+	if _, err := Fsck(true); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := Fsck(false); len(r.Issues) != 0 {
+		t.Fatal(r.Issues)
+	}
+
+	res, _ := WalkMulti(false, 10, ik.ParseID(root))
+	if len(res) != 3 || res[0].ID != orphan.ID {
+		t.Fatal(res)
+	}
+	if a, _ := GetArticle(a2.ID); a.Replies != 0 || a.ReplyChain != "" {
+		t.Fatal(a)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	defer initMemory()()
+
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m.cold, _ = cold.Open(dir)
+
+	if err := Do(NewRequest(DoUpdateUser, "ID", "erin", "Signup", true)); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := GetUser("erin")
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		a, _ := Post(&model.Article{Content: strconv.Itoa(i)}, u, true)
+		ids = append(ids, a.ID)
+	}
+
+	r, err := Archive(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Archived < 5 || r.Skipped != 0 {
+		t.Fatal(r)
+	}
+	if p, _ := m.hot.Get(ids[0]); len(p) != 0 {
+		t.Fatal("not deleted")
+	}
+
+	res, _ := WalkMulti(false, 10, ik.NewID(ik.IDAuthor, "erin"))
+	if len(res) != 5 || res[0].ID != ids[4] || res[4].Content != "0" {
+		t.Fatal(res)
+	}
+	if r, _ := Fsck(false); len(r.Issues) != 0 {
+		t.Fatal(r.Issues)
+	}
+
+	// Writing brings it back
+	if err := Do(NewRequest(DoUpdateArticle, "ID", ids[0], "IncDecLikes", true)); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := m.hot.Get(ids[0]); len(p) == 0 {
+		t.Fatal("not restored")
+	}
+	if a, _ := GetArticle(ids[0]); a.Likes != 1 {
+		t.Fatal(a)
+	}
+}
+
+// racingKV runs 'write' once before the first CompareAndDelete, like a server writing during Archive
+type racingKV struct {
+	KeyValueOp
+	write func(key string)
+}
+
+func (r *racingKV) CompareAndDelete(key string, ver uint64) error {
+	if w := r.write; w != nil {
+		r.write = nil
+		w(key)
+	}
+	return r.KeyValueOp.CompareAndDelete(key, ver)
+}
+
+func TestArchiveRace(t *testing.T) {
+	defer initMemory()()
+
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m.cold, _ = cold.Open(dir)
+
+	if err := Do(NewRequest(DoUpdateUser, "ID", "hank", "Signup", true)); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := GetUser("hank")
+	for i := 0; i < 5; i++ {
+		Post(&model.Article{Content: strconv.Itoa(i)}, u, true)
+	}
+
+	written := ""
+	m.hot = &racingKV{KeyValueOp: m.hot, write: func(key string) {
+		written = key
+		if err := Do(NewRequest(DoUpdateArticle, "ID", key, "IncDecLikes", true)); err != nil {
+			t.Fatal(err)
+		}
+	}}
+
+	r, err := Archive(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Archived != 4 || r.Skipped != 1 {
+		t.Fatal(r)
+	}
+	if p, _ := m.hot.Get(written); len(p) == 0 {
+		t.Fatal("deleted after a write")
+	}
+	if a, _ := GetArticle(written); a.Likes != 1 {
+		t.Fatal(a)
+	}
+}
+
+// conflictKV fails the first 'conflicts' CompareAndSets and counts checkpoint writes
+type conflictKV struct {
+	KeyValueOp
+	mu          sync.Mutex
+	conflicts   int
+	checkpoints int
+}
+
+func (c *conflictKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conflicts > 0 {
+		c.conflicts--
+		return kv.ErrConflict
+	}
+	return c.KeyValueOp.CompareAndSet(key, value, ver)
+}
+
+func (c *conflictKV) Set(key string, value []byte) error {
+	c.mu.Lock()
+	if strings.Contains(key, "/checkpoint/") {
+		c.checkpoints++
+	}
+	c.mu.Unlock()
+	return c.KeyValueOp.Set(key, value)
+}
+
+func TestCheckpoint(t *testing.T) {
+	defer initMemory()()
+
+	// The last article of "ivy" was posted two months ago
+	p := ik.NewGeneralID().Marshal(nil)
+	binary.BigEndian.PutUint32(p[1:], uint32(time.Now().AddDate(0, -2, 0).Unix()))
+	last := ik.UnmarshalID(p).String()
+	rootID := ik.NewID(ik.IDAuthor, "ivy").String()
+	m.db.Set(rootID, (&model.Article{ID: rootID, NextID: last, CreateTime: time.Now()}).Marshal())
+
+	c := &conflictKV{KeyValueOp: m.db, conflicts: 3}
+	m.db = c
+	a := model.Article{ID: ik.NewGeneralID().String()}
+	if err := Do(NewRequest(DoInsertArticle, "RootID", rootID, "Article", a)); err != nil {
+		t.Fatal(err)
+	}
+	background.Wait()
+
+	if c.checkpoints != 1 {
+		t.Fatal(c.checkpoints)
+	}
+	root, _ := GetArticle(rootID)
+	cp, _ := c.Get(makeCheckpointID("ivy", root.CreateTime))
+	if x, _ := model.UnmarshalArticle(cp); x == nil || x.ReferID != last {
+		t.Fatal(x)
+	}
+}
+
+func TestWalkLikes(t *testing.T) {
+	defer initMemory()()
+
+	if err := Do(NewRequest(DoUpdateUser, "ID", "gina", "Signup", true)); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := GetUser("gina")
+	ids := []string{}
+	for i := 0; i < 4; i++ {
+		a, _ := Post(&model.Article{Content: strconv.Itoa(i)}, u, true)
+		if err := LikeArticle("gina", a.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, a.ID)
+	}
+	// A liked article which is gone doesn't count
+	m.db.Delete(ids[3])
+
+	head, _ := GetArticle(ik.NewID(ik.IDLike, "gina").String())
+	res, next := WalkLikes(false, 2, head.NextID)
+	if len(res) != 2 || res[0].ID != ids[2] || res[1].ID != ids[1] || next == "" {
+		t.Fatal(res, next)
+	}
+	res, next = WalkLikes(false, 2, next)
+	if len(res) != 1 || res[0].ID != ids[0] || next != "" {
+		t.Fatal(res, next)
+	}
+}
+
+func TestUserCacheCopy(t *testing.T) {
+	defer initMemory()()
+
+	u := &model.User{ID: "hank", PasswordHash: []byte("hash")}
+	m.users.Add(u)
+	u.PasswordHash[0] = 'x'
+	u2 := m.users.Get("hank")
+	if string(u2.PasswordHash) != "hash" {
+		t.Fatal(string(u2.PasswordHash))
+	}
+	u2.PasswordHash[0] = 'y'
+	if u3 := m.users.Get("hank"); string(u3.PasswordHash) != "hash" {
+		t.Fatal(string(u3.PasswordHash))
+	}
+}
+
+func TestOpenShards(t *testing.T) {
+	s, err := openShards([]string{"50]a=memory", "50]b=memory;compress=100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("k", []byte("v"))
+	if v, _ := s.Get("k"); string(v) != "v" {
+		t.Fatal(v)
+	}
+	for _, spec := range []string{"50]memory", "50]=memory", "50]disk:a=b", "5]a=memory"} {
+		if _, err := openShards([]string{spec}); err == nil {
+			t.Fatal(spec)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Package feed is the change feed of the storage: every Set/Delete going through dal is published here
+package feed
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+type Event struct {
+	Offset     uint64 // position after this event in the durable log, resume from it to get later events, 0 if not logged
+	Key        string
+	OldVersion uint64 // version before the write, 0 if the key didn't exist or the version is unknown
+	Value      []byte // nil when deleted
+	Deleted    bool
+	Time       int64 // unix nano
+}
+
+// Publisher receives events in the order they are published, events are shared and must not be modified.
+// Publish is called concurrently, publishers serialize their own writes.
+type Publisher interface {
+	Publish(e *Event) error
+}
+
+// Feed fans out events to its publishers and in-process subscribers
+type Feed struct {
+	mu   sync.RWMutex
+	pubs []Publisher
+	subs map[*Subscription]bool
+	log  *Log
+}
+
+// New creates a feed, a *Log among 'pubs' should come first so the other publishers see offsets
+func New(pubs ...Publisher) *Feed {
+	f := &Feed{
+		pubs: pubs,
+		subs: map[*Subscription]bool{},
+	}
+	for _, p := range pubs {
+		if l, ok := p.(*Log); ok && f.log == nil {
+			f.log = l
+		}
+	}
+	return f
+}
+
+// Active tells whether there is any publisher or subscriber, writes skip the feed otherwise
+func (f *Feed) Active() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.pubs) > 0 || len(f.subs) > 0
+}
+
+// Log returns the durable log, or nil if there is none
+func (f *Feed) Log() *Log {
+	return f.log
+}
+
+func (f *Feed) AddPublisher(p Publisher) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pubs = append(f.pubs, p)
+}
+
+// Publish returns the first error of publishers, every publisher and subscriber still gets the event
+func (f *Feed) Publish(e *Event) error {
+	// The lock is not held while publishers write, AddPublisher only appends so the slice can be shared
+	f.mu.RLock()
+	pubs := f.pubs
+	f.mu.RUnlock()
+
+	var err error
+	for _, p := range pubs {
+		if err2 := p.Publish(e); err2 != nil {
+			log.Println("[Feed] publish:", e.Key, err2)
+			if err == nil {
+				err = err2
+			}
+		}
+	}
+
+	f.mu.RLock()
+	for s := range f.subs {
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+	f.mu.RUnlock()
+	return err
+}
+
+// Subscription never blocks the feed, events are dropped when C is full. Events of concurrent writes
+// may arrive out of Offset order, subscribers which can't afford losing events should resume from
+// the durable log using Event.Offset.
+type Subscription struct {
+	C       <-chan *Event
+	c       chan *Event
+	dropped uint64
+}
+
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (f *Feed) Subscribe(buffer int) *Subscription {
+	s := &Subscription{c: make(chan *Event, buffer)}
+	s.C = s.c
+
+	f.mu.Lock()
+	f.subs[s] = true
+	f.mu.Unlock()
+	return s
+}
+
+// Unsubscribe closes s.C
+func (f *Feed) Unsubscribe(s *Subscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs[s] {
+		delete(f.subs, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,132 @@
+package feed
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestFeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	segmentSize = 1024
+	l, err := OpenLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := New(l)
+	sub := f.Subscribe(10)
+
+	for i := 0; i < 100; i++ {
+		e := &Event{Key: strconv.Itoa(i), OldVersion: uint64(i), Value: []byte(strconv.Itoa(i)), Deleted: i%10 == 9}
+		if e.Deleted {
+			e.Value = nil
+		}
+		if err := f.Publish(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(sub.C) != 10 || sub.Dropped() != 90 {
+		t.Fatal(len(sub.C), sub.Dropped())
+	}
+	f.Unsubscribe(sub)
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*.feed"))
+	t.Log("segments:", len(names))
+
+	check := func(l *Log) {
+		offset, i := uint64(0), 0
+		for {
+			res, err := l.Read(offset, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) == 0 {
+				break
+			}
+			for _, e := range res {
+				if e.Key != strconv.Itoa(i) || e.OldVersion != uint64(i) || e.Deleted != (i%10 == 9) {
+					t.Fatal(i, e)
+				}
+				i++
+			}
+			offset = res[len(res)-1].Offset
+		}
+		if i != 100 || offset != l.End() {
+			t.Fatal(i, offset, l.End())
+		}
+	}
+	check(l)
+
+	// Torn tail
+	end := l.End()
+	l.Close()
+	names, _ = filepath.Glob(filepath.Join(dir, "*.feed"))
+	fh, _ := os.OpenFile(names[len(names)-1], os.O_WRONLY|os.O_APPEND, 0666)
+	fh.Write([]byte("garbage"))
+	fh.Close()
+
+	l, err = OpenLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.End() != end {
+		t.Fatal(l.End(), end)
+	}
+	check(l)
+
+	if err := l.Truncate(end / 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Read(0, 1); err != ErrTruncated {
+		t.Fatal(err)
+	}
+}
+
+func TestLogLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := OpenLogReadOnly(dir); err == nil {
+		t.Fatal("opened an empty dir")
+	}
+	l, err := OpenLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Publish(&Event{Key: "a", Value: []byte("1")})
+
+	if _, err := OpenLog(dir); err == nil {
+		t.Fatal("opened a locked log")
+	}
+
+	// A torn tail may be an event being written, readers must leave it alone
+	s := l.segs[0]
+	s.f.WriteAt([]byte("torn"), int64(l.end))
+	r, err := OpenLogReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if res, err := r.Read(0, 10); err != nil || len(res) != 1 || res[0].Key != "a" {
+		t.Fatal(res, err)
+	}
+	if err := r.Publish(&Event{Key: "b"}); err != errReadOnly {
+		t.Fatal(err)
+	}
+	if fi, _ := s.f.Stat(); fi.Size() != int64(l.end)+4 {
+		t.Fatal(fi.Size(), l.end)
+	}
+}
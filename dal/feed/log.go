@@ -0,0 +1,395 @@
+package feed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/iis/common"
+)
+
+// Record layout (little endian):
+//
+//	crc32 | flags (1) | old version (8) | time (8) | keylen (4) | vallen (4) | key | value
+//
+// crc32 covers everything after itself. Offsets are global byte positions across all segments,
+// a segment is named after the offset of its first record.
+const (
+	recHeaderSize = 4 + 1 + 8 + 8 + 4 + 4
+	recMaxKey     = 1 << 16
+	recMaxValue   = 1 << 30
+
+	recDelete = 1 << 0
+)
+
+var segmentSize uint64 = 64 << 20
+
+var (
+	ErrTruncated = fmt.Errorf("feed: offset has been truncated")
+	errClosed    = fmt.Errorf("feed: log closed")
+	errReadOnly  = fmt.Errorf("feed: log opened read-only")
+)
+
+type segment struct {
+	base uint64
+	f    *os.File
+}
+
+// Log is the durable change feed. Records are written to the OS right away and fsync-ed every second,
+// so a process crash loses nothing but an OS crash may lose the last second.
+// Only one process can open the log for writing, it holds an exclusive lock on "<dir>/LOCK".
+type Log struct {
+	dir      string
+	lock     *os.File
+	readOnly bool
+
+	mu    sync.RWMutex
+	segs  []*segment // the last one is being written
+	end   uint64
+	dirty bool
+}
+
+func OpenLog(dir string) (*Log, error) {
+	return openLog(dir, false)
+}
+
+// OpenLogReadOnly opens the log without the lock for readers running next to the writer, e.g. 'iis backup -since'.
+// It sees the events written before it is opened, a torn tail (may be an event being written) is ignored
+// instead of truncated, Publish and Truncate fail.
+func OpenLogReadOnly(dir string) (*Log, error) {
+	return openLog(dir, true)
+}
+
+func openLog(dir string, readOnly bool) (*Log, error) {
+	l := &Log{dir: dir, readOnly: readOnly}
+	if !readOnly {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+		lock, err := common.LockFile(filepath.Join(dir, "LOCK"))
+		if err != nil {
+			return nil, fmt.Errorf("feed: %v", err)
+		}
+		l.lock = lock
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.feed"))
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	sort.Strings(names)
+
+	if readOnly && len(names) == 0 {
+		return nil, fmt.Errorf("feed: no log in %q", dir)
+	}
+
+	for i, name := range names {
+		base, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".feed"), 10, 64)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("invalid feed segment: %q", name)
+		}
+
+		flag := os.O_RDONLY
+		if i == len(names)-1 && !readOnly {
+			flag = os.O_RDWR
+		}
+		f, err := os.OpenFile(name, flag, 0666)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.segs = append(l.segs, &segment{base: base, f: f})
+	}
+
+	if len(l.segs) == 0 {
+		if err := l.newSegment(0); err != nil {
+			l.Close()
+			return nil, err
+		}
+	} else if err := l.recover(); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	if readOnly {
+		return l, nil
+	}
+
+	go func() {
+		for range time.Tick(time.Second) {
+			if err := l.Sync(); err != nil {
+				log.Println("[Feed] sync:", err)
+			}
+		}
+	}()
+
+	return l, nil
+}
+
+func (l *Log) newSegment(base uint64) error {
+	f, err := os.OpenFile(filepath.Join(l.dir, fmt.Sprintf("%020d.feed", base)), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	l.segs = append(l.segs, &segment{base: base, f: f})
+	l.end = base
+	return nil
+}
+
+// recover finds the end of the last segment, any torn or corrupted tail will be truncated
+func (l *Log) recover() error {
+	s := l.segs[len(l.segs)-1]
+	rd := bufio.NewReaderSize(io.NewSectionReader(s.f, 0, 1<<62), 1<<20)
+
+	off := int64(0)
+	for {
+		_, size, err := readRecord(rd)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && l.readOnly {
+			log.Println("[Feed] recover: bad record at", s.base+uint64(off), "error:", err, "ignored, opened read-only")
+			break
+		}
+		if err != nil {
+			log.Println("[Feed] recover: bad record at", s.base+uint64(off), "error:", err, "truncating")
+			if err := s.f.Truncate(off); err != nil {
+				return err
+			}
+			break
+		}
+		off += size
+	}
+
+	l.end = s.base + uint64(off)
+	return nil
+}
+
+func readRecord(rd io.Reader) (e *Event, size int64, err error) {
+	hdr := [recHeaderSize]byte{}
+	if _, err = io.ReadFull(rd, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("short header")
+		}
+		return
+	}
+
+	klen, vlen := binary.LittleEndian.Uint32(hdr[21:]), binary.LittleEndian.Uint32(hdr[25:])
+	if klen > recMaxKey || vlen > recMaxValue {
+		err = fmt.Errorf("invalid record size: %d/%d", klen, vlen)
+		return
+	}
+
+	buf := make([]byte, int(klen)+int(vlen))
+	if _, err = io.ReadFull(rd, buf); err != nil {
+		err = fmt.Errorf("short record: %v", err)
+		return
+	}
+
+	h := crc32.NewIEEE()
+	h.Write(hdr[4:])
+	h.Write(buf)
+	if h.Sum32() != binary.LittleEndian.Uint32(hdr[:4]) {
+		err = fmt.Errorf("checksum mismatch")
+		return
+	}
+
+	e = &Event{
+		Key:        string(buf[:klen]),
+		OldVersion: binary.LittleEndian.Uint64(hdr[5:]),
+		Time:       int64(binary.LittleEndian.Uint64(hdr[13:])),
+		Deleted:    hdr[4]&recDelete != 0,
+	}
+	if !e.Deleted {
+		e.Value = buf[klen:]
+	}
+	size = int64(recHeaderSize + len(buf))
+	return
+}
+
+func appendRecord(buf []byte, e *Event) []byte {
+	hdr := [recHeaderSize]byte{}
+	if e.Deleted {
+		hdr[4] = recDelete
+	}
+	binary.LittleEndian.PutUint64(hdr[5:], e.OldVersion)
+	binary.LittleEndian.PutUint64(hdr[13:], uint64(e.Time))
+	binary.LittleEndian.PutUint32(hdr[21:], uint32(len(e.Key)))
+	binary.LittleEndian.PutUint32(hdr[25:], uint32(len(e.Value)))
+
+	h := crc32.NewIEEE()
+	h.Write(hdr[4:])
+	h.Write([]byte(e.Key))
+	h.Write(e.Value)
+	binary.LittleEndian.PutUint32(hdr[:4], h.Sum32())
+
+	buf = append(buf, hdr[:]...)
+	buf = append(buf, e.Key...)
+	return append(buf, e.Value...)
+}
+
+// Publish appends the event to the log and sets e.Offset
+func (l *Log) Publish(e *Event) error {
+	if l.readOnly {
+		return errReadOnly
+	}
+	if len(e.Key) > recMaxKey || len(e.Value) > recMaxValue {
+		return fmt.Errorf("feed: event too large: %q", e.Key)
+	}
+
+	buf := appendRecord(nil, e)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.segs) == 0 {
+		return errClosed
+	}
+
+	s := l.segs[len(l.segs)-1]
+	if l.end-s.base >= segmentSize {
+		if err := s.f.Sync(); err != nil {
+			return err
+		}
+		if err := l.newSegment(l.end); err != nil {
+			return err
+		}
+		s = l.segs[len(l.segs)-1]
+	}
+
+	if _, err := s.f.WriteAt(buf, int64(l.end-s.base)); err != nil {
+		s.f.Truncate(int64(l.end - s.base))
+		return err
+	}
+
+	l.end += uint64(len(buf))
+	l.dirty = true
+	e.Offset = l.end
+	return nil
+}
+
+// Start returns the offset of the first event which has not been truncated
+func (l *Log) Start() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.segs) == 0 {
+		return l.end
+	}
+	return l.segs[0].base
+}
+
+// End returns the offset after the last event
+func (l *Log) End() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.end
+}
+
+// Read returns at most 'limit' events after 'offset', which is either 0 or Event.Offset of a previous event.
+// ErrTruncated is returned if the events after 'offset' have been removed by Truncate.
+func (l *Log) Read(offset uint64, limit int) ([]*Event, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.segs) == 0 {
+		return nil, errClosed
+	}
+	if offset > l.end {
+		return nil, fmt.Errorf("feed: offset %d beyond the end %d", offset, l.end)
+	}
+	if offset < l.segs[0].base {
+		return nil, ErrTruncated
+	}
+
+	i := sort.Search(len(l.segs), func(i int) bool { return l.segs[i].base > offset }) - 1
+
+	res := []*Event{}
+	for ; i < len(l.segs) && len(res) < limit; i++ {
+		s, end := l.segs[i], l.end
+		if i < len(l.segs)-1 {
+			end = l.segs[i+1].base
+		}
+		if offset < s.base {
+			offset = s.base
+		}
+
+		rd := bufio.NewReader(io.NewSectionReader(s.f, int64(offset-s.base), int64(end-offset)))
+		for len(res) < limit && offset < end {
+			e, size, err := readRecord(rd)
+			if err != nil {
+				return nil, fmt.Errorf("feed: read at %d: %v", offset, err)
+			}
+			offset += uint64(size)
+			e.Offset = offset
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
+// Truncate removes segments which only contain events before 'offset', the last segment is always kept
+func (l *Log) Truncate(offset uint64) error {
+	if l.readOnly {
+		return errReadOnly
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for len(l.segs) > 1 && l.segs[1].base <= offset {
+		s := l.segs[0]
+		s.f.Close()
+		if err := os.Remove(s.f.Name()); err != nil {
+			return err
+		}
+		l.segs = l.segs[1:]
+	}
+	return nil
+}
+
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	if !l.dirty || len(l.segs) == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.dirty = false
+	f := l.segs[len(l.segs)-1].f
+	l.mu.Unlock()
+
+	// Appending goes on while syncing, older segments are synced before rotation
+	return f.Sync()
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	if l.dirty && len(l.segs) > 0 {
+		err = l.segs[len(l.segs)-1].f.Sync()
+	}
+	for _, s := range l.segs {
+		if err2 := s.f.Close(); err == nil {
+			err = err2
+		}
+	}
+	l.segs = nil
+	if l.lock != nil {
+		l.lock.Close()
+		l.lock = nil
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package dal
+
+import (
+	"log"
+	"time"
+
+	"github.com/coyove/iis/dal/feed"
+)
+
+// feedKV publishes every successful Set/Delete to the change feed, writes go straight through
+// when the feed has no publisher or subscriber. Old versions of Set and Delete are only read
+// for the durable log, right before the write, so they are exact only when writes of the key
+// are serialized (common.LockKey), CompareAndSet is always exact.
+type feedKV struct {
+	KeyValueOp
+	feed *feed.Feed
+}
+
+func (m *feedKV) publish(key string, oldVer uint64, value []byte, deleted bool) {
+	if err := m.feed.Publish(&feed.Event{
+		Key:        key,
+		OldVersion: oldVer,
+		Value:      value,
+		Deleted:    deleted,
+		Time:       time.Now().UnixNano(),
+	}); err != nil {
+		// The write has been done, failing it would make callers retry a write which already happened
+		log.Println("[feedKV] publish:", key, err)
+	}
+}
+
+func (m *feedKV) oldVersion(key string) uint64 {
+	if m.feed.Log() == nil {
+		return 0
+	}
+	_, ver, err := m.KeyValueOp.GetWithVersion(key)
+	if err != nil {
+		return 0
+	}
+	return ver
+}
+
+func (m *feedKV) Set(key string, value []byte) error {
+	if !m.feed.Active() {
+		return m.KeyValueOp.Set(key, value)
+	}
+	ver := m.oldVersion(key)
+	if err := m.KeyValueOp.Set(key, value); err != nil {
+		return err
+	}
+	m.publish(key, ver, value, false)
+	return nil
+}
+
+func (m *feedKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	if !m.feed.Active() {
+		return m.KeyValueOp.CompareAndSet(key, value, ver)
+	}
+	if err := m.KeyValueOp.CompareAndSet(key, value, ver); err != nil {
+		return err
+	}
+	m.publish(key, ver, value, false)
+	return nil
+}
+
+func (m *feedKV) CompareAndDelete(key string, ver uint64) error {
+	if !m.feed.Active() {
+		return m.KeyValueOp.CompareAndDelete(key, ver)
+	}
+	if err := m.KeyValueOp.CompareAndDelete(key, ver); err != nil {
+		return err
+	}
+	m.publish(key, ver, nil, true)
+	return nil
+}
+
+func (m *feedKV) Delete(key string) error {
+	if !m.feed.Active() {
+		return m.KeyValueOp.Delete(key)
+	}
+	ver := m.oldVersion(key)
+	if err := m.KeyValueOp.Delete(key); err != nil {
+		return err
+	}
+	m.publish(key, ver, nil, true)
+	return nil
+}
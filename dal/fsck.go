@@ -0,0 +1,454 @@
+package dal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/coyove/iis/dal/kv"
+	"github.com/coyove/iis/ik"
+	"github.com/coyove/iis/model"
+)
+
+// Chains checked by fsck, a head starts its reply chain with ReplyChain instead of NextReplyID
+const (
+	fsckNext = iota
+	fsckMedia
+	fsckReply
+)
+
+var fsckLinkNames = [...]string{"NextID", "NextMediaID", "NextReplyID"}
+
+type FsckIssue struct {
+	Kind   string // cycle, dangling, orphan or counter
+	Key    string
+	Detail string
+	Fixed  bool
+}
+
+func (i FsckIssue) String() string {
+	s := "[" + i.Kind + "] " + i.Key + ": " + i.Detail
+	if i.Fixed {
+		s += " (fixed)"
+	}
+	return s
+}
+
+type FsckReport struct {
+	Articles int
+	Users    int
+	Chains   int
+	Issues   []FsckIssue
+}
+
+type fsckNode struct {
+	links      [3]string
+	replyChain string
+	refer      string
+	parent     string
+	author     string
+	cmd        model.Cmd
+	alone      bool
+	media      bool
+	replies    int
+	likes      int32
+	created    int64
+}
+
+type fsckUser struct {
+	followers  int32
+	followings int32
+	unread     int32
+}
+
+type fsck struct {
+	repair bool
+	report *FsckReport
+
+	keys    []string // sorted keys of nodes, archived nodes are not included
+	nodes   map[string]*fsckNode
+	users   map[string]*fsckUser
+	chains  [3]map[string][]string // head -> keys in the chain
+	reached [3]map[string]bool
+
+	alone      map[string]int // author root -> number of alone articles
+	likes      map[string]int32
+	followers  map[string]int32
+	followings map[string]int32
+}
+
+// Fsck walks every chain, detects cycles, dangling references and orphaned articles,
+// then recomputes counters. Issues are fixed when 'repair' is true.
+// The whole index of articles is kept in memory, so it is meant to be run offline ('iis fsck').
+func Fsck(repair bool) (*FsckReport, error) {
+	f := &fsck{
+		repair:     repair,
+		report:     &FsckReport{},
+		nodes:      map[string]*fsckNode{},
+		users:      map[string]*fsckUser{},
+		alone:      map[string]int{},
+		likes:      map[string]int32{},
+		followers:  map[string]int32{},
+		followings: map[string]int32{},
+	}
+	for i := range f.chains {
+		f.chains[i] = map[string][]string{}
+		f.reached[i] = map[string]bool{}
+	}
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.walkAll()
+	f.checkOrphans()
+	f.checkCounters()
+	return f.report, nil
+}
+
+func (f *fsck) issue(kind, key, detail string, fix func() error) {
+	i := FsckIssue{Kind: kind, Key: key, Detail: detail}
+	if f.repair && fix != nil {
+		if err := fix(); err != nil {
+			i.Detail += ", failed to fix: " + err.Error()
+		} else {
+			i.Fixed = true
+		}
+	}
+	log.Println("[Fsck]", i)
+	f.report.Issues = append(f.report.Issues, i)
+}
+
+func (f *fsck) load() error {
+	likes := []string{}
+
+	err := scanAll("", func(p kv.Pair) error {
+		if isUserKey(p.Key) {
+			u, err := model.UnmarshalUser(p.Value)
+			if err == nil {
+				f.users[u.ID] = &fsckUser{followers: u.Followers, followings: u.Followings, unread: u.Unread}
+			}
+			return nil
+		}
+
+		a, err := model.UnmarshalArticle(p.Value)
+		if err != nil || a.ID != p.Key {
+			return nil // not an article
+		}
+
+		f.keys = append(f.keys, p.Key)
+		f.nodes[p.Key] = newFsckNode(a)
+
+		if a.Alone && a.Parent == "" {
+			f.alone[ik.NewID(ik.IDAuthor, a.Author).String()]++
+		}
+
+		switch a.Cmd {
+		case model.CmdLike:
+			if a.Extras["like"] == "true" {
+				likes = append(likes, a.Extras["to"])
+			}
+		case model.CmdFollow:
+			for _, v := range a.Extras {
+				if strings.HasPrefix(v, "true,") {
+					f.followings[keyOwner(p.Key)]++
+				}
+			}
+		case model.CmdFollowed:
+			if a.Extras["followed"] == "true" {
+				f.followers[keyOwner(p.Key)]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Likes go to the referred article, see getArticleForUpdate
+	for _, id := range likes {
+		for i := 0; i < 8 && f.nodes[id] != nil && f.nodes[id].refer != ""; i++ {
+			id = f.nodes[id].refer
+		}
+		f.likes[id]++
+	}
+
+	sort.Strings(f.keys)
+	f.report.Articles, f.report.Users = len(f.nodes), len(f.users)
+	return nil
+}
+
+func newFsckNode(a *model.Article) *fsckNode {
+	return &fsckNode{
+		links:      [3]string{a.NextID, a.NextMediaID, a.NextReplyID},
+		replyChain: a.ReplyChain,
+		refer:      a.ReferID,
+		parent:     a.Parent,
+		author:     a.Author,
+		cmd:        a.Cmd,
+		alone:      a.Alone,
+		media:      a.Media != "",
+		replies:    a.Replies,
+		likes:      a.Likes,
+		created:    a.CreateTime.UnixNano(),
+	}
+}
+
+// node returns the node of the key, archived articles are loaded from cold segments on demand
+func (f *fsck) node(key string) *fsckNode {
+	if n := f.nodes[key]; n != nil {
+		return n
+	}
+	p, _ := getCold(key)
+	if len(p) == 0 {
+		return nil
+	}
+	a, err := model.UnmarshalArticle(p)
+	if err != nil {
+		return nil
+	}
+	n := newFsckNode(a)
+	f.nodes[key] = n
+	return n
+}
+
+// keyOwner returns the user of keys like "u/<id>/..."
+func keyOwner(key string) string {
+	p := strings.SplitN(key, "/", 3)
+	if len(p) < 3 || p[0] != "u" {
+		return ""
+	}
+	return p[1]
+}
+
+func (f *fsck) link(key string, kind int, head bool) string {
+	if kind == fsckReply && head {
+		return f.nodes[key].replyChain
+	}
+	return f.nodes[key].links[kind]
+}
+
+func (f *fsck) linkName(kind int, head bool) string {
+	if kind == fsckReply && head {
+		return "ReplyChain"
+	}
+	return fsckLinkNames[kind]
+}
+
+// setLink updates both the record and the in-memory node
+func (f *fsck) setLink(key string, kind int, head bool, next string) error {
+	if err := updateArticleRaw(key, func(a *model.Article) {
+		switch {
+		case kind == fsckReply && head:
+			a.ReplyChain = next
+		case kind == fsckReply:
+			a.NextReplyID = next
+		case kind == fsckMedia:
+			a.NextMediaID = next
+		default:
+			a.NextID = next
+		}
+	}); err != nil {
+		return err
+	}
+	if kind == fsckReply && head {
+		f.nodes[key].replyChain = next
+	} else {
+		f.nodes[key].links[kind] = next
+	}
+	return nil
+}
+
+func (f *fsck) walkAll() {
+	for _, key := range f.keys {
+		n := f.nodes[key]
+		if ik.ParseID(key).IsRoot() {
+			f.walk(key, fsckNext)
+			f.walk(key, fsckMedia)
+		}
+		if n.replyChain != "" {
+			f.walk(key, fsckReply)
+		}
+		if n.refer != "" && f.node(n.refer) == nil {
+			key := key
+			f.issue("dangling", key, "ReferID -> "+n.refer+": not found", func() error {
+				return updateArticleRaw(key, func(a *model.Article) {
+					a.ReferID, a.Content = "", model.DeletionMarker
+				})
+			})
+		}
+	}
+}
+
+func (f *fsck) walk(head string, kind int) {
+	f.report.Chains++
+	visited := map[string]bool{head: true}
+	chain := []string{}
+
+	for prev, next := head, f.link(head, kind, true); next != ""; {
+		isHead := prev == head
+		cut := func() error { return f.setLink(prev, kind, isHead, "") }
+
+		n := f.node(next)
+		if n == nil {
+			f.issue("dangling", prev, f.linkName(kind, isHead)+" -> "+next+": not found", cut)
+			break
+		}
+		if visited[next] {
+			f.issue("cycle", prev, f.linkName(kind, isHead)+" -> "+next+": visited in the chain of "+head, cut)
+			break
+		}
+
+		visited[next] = true
+		f.reached[kind][next] = true
+		chain = append(chain, next)
+		prev, next = next, n.links[kind]
+	}
+	f.chains[kind][head] = chain
+}
+
+func (f *fsck) checkOrphans() {
+	for _, key := range f.keys {
+		n := f.nodes[key]
+		if id := ik.ParseID(key); id.Header() != ik.IDGeneral || id.IsRoot() || n.alone {
+			continue
+		}
+
+		if n.parent != "" {
+			if _, walked := f.chains[fsckReply][n.parent]; !walked && f.node(n.parent) != nil {
+				// Archived parents are not in f.keys, walk their reply chains here
+				f.walk(n.parent, fsckReply)
+			}
+			if !f.reached[fsckReply][key] {
+				f.orphan(key, n.parent, fsckReply)
+			}
+			continue
+		}
+
+		if f.reached[fsckNext][key] {
+			continue
+		}
+		if n.author == "" || n.refer != "" || n.cmd != model.CmdNone {
+			// Notifications and references, we don't know which chain they belong to
+			f.issue("orphan", key, "not in any chain", nil)
+			continue
+		}
+		root := ik.NewID(ik.IDAuthor, n.author).String()
+		f.orphan(key, root, fsckNext)
+		if n.media && !f.reached[fsckMedia][key] {
+			f.orphan(key, root, fsckMedia)
+		}
+	}
+}
+
+func (f *fsck) orphan(key, head string, kind int) {
+	f.issue("orphan", key, "not in the "+fsckLinkNames[kind]+" chain of "+head, func() error {
+		if f.nodes[head] == nil {
+			return model.ErrNotExisted
+		}
+		return f.insert(head, key, kind)
+	})
+}
+
+// insert links 'key' into the chain by its create time, chains are sorted from the newest to the oldest
+func (f *fsck) insert(head, key string, kind int) error {
+	chain, created := f.chains[kind][head], f.nodes[key].created
+	i := sort.Search(len(chain), func(i int) bool { return f.nodes[chain[i]].created < created })
+
+	prev, next := head, ""
+	if i > 0 {
+		prev = chain[i-1]
+	}
+	if i < len(chain) {
+		next = chain[i]
+	}
+
+	// Same order as coInsertArticle: the new node first, then the one pointing to it
+	if err := f.setLink(key, kind, false, next); err != nil {
+		return err
+	}
+	if err := f.setLink(prev, kind, prev == head, key); err != nil {
+		return err
+	}
+
+	f.chains[kind][head] = append(chain[:i], append([]string{key}, chain[i:]...)...)
+	f.reached[kind][key] = true
+	return nil
+}
+
+func (f *fsck) checkCounters() {
+	for _, key := range f.keys {
+		n, id := f.nodes[key], ik.ParseID(key)
+
+		var replies int
+		var likes int32
+		switch {
+		case id.IsRoot():
+			replies, likes = len(f.chains[fsckNext][key])+f.alone[key], n.likes
+		case id.Header() == ik.IDGeneral && n.refer == "":
+			replies, likes = len(f.chains[fsckReply][key]), f.likes[key]
+		default:
+			continue
+		}
+
+		if n.replies != replies || n.likes != likes {
+			f.issue("counter", key, fmt.Sprintf("Replies/Likes: %d/%d, should be %d/%d", n.replies, n.likes, replies, likes), func() error {
+				return updateArticleRaw(key, func(a *model.Article) {
+					a.Replies, a.Likes = replies, likes
+				})
+			})
+		}
+	}
+
+	ids := make([]string, 0, len(f.users))
+	for id := range f.users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		u := f.users[id]
+		followers, followings, unread := f.followers[id], f.followings[id], u.unread
+		// Unread can't be recomputed, but it can't exceed the size of the inbox
+		if inbox := int32(len(f.chains[fsckNext][ik.NewID(ik.IDInbox, id).String()])); unread > inbox {
+			unread = inbox
+		}
+
+		if u.followers != followers || u.followings != followings || u.unread != unread {
+			id := id
+			f.issue("counter", "u/"+id, fmt.Sprintf("Followers/Followings/Unread: %d/%d/%d, should be %d/%d/%d",
+				u.followers, u.followings, u.unread, followers, followings, unread), func() error {
+				return updateUserRaw(id, func(u *model.User) {
+					u.Followers, u.Followings, u.Unread = followers, followings, unread
+				})
+			})
+		}
+	}
+}
+
+// updateArticleRaw updates the record itself, without following ReferID
+func updateArticleRaw(key string, fn func(a *model.Article)) error {
+	p, ver, err := m.db.GetWithVersion(key)
+	if err != nil {
+		return err
+	}
+	if len(p) == 0 {
+		return model.ErrNotExisted
+	}
+	a, err := model.UnmarshalArticle(p)
+	if err != nil {
+		return err
+	}
+	fn(a)
+	return m.db.CompareAndSet(key, a.Marshal(), ver)
+}
+
+func updateUserRaw(id string, fn func(u *model.User)) error {
+	u, ver, err := getUserForUpdate(id)
+	if err != nil {
+		return err
+	}
+	fn(u)
+	m.users.Delete(id)
+	return m.db.CompareAndSet("u/"+id, u.Marshal(), ver)
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// breaker opens after 'threshold' consecutive Redis failures, it is only closed by GlobalCache.heal
+// once Redis answers again and keys written during the outage have been purged.
+type breaker struct {
+	threshold int
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	since    time.Time
+}
+
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	if !b.open {
+		b.failures = 0
+	}
+	b.mu.Unlock()
+}
+
+func (b *breaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures++; b.failures >= b.threshold && !b.open {
+		b.open, b.since = true, time.Now()
+		log.Println("[GlobalCache_redis] circuit opened after", b.failures, "failures, last error:", err)
+	}
+}
+
+func (b *breaker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open {
+		log.Println("[GlobalCache_redis] circuit closed, degraded for", time.Since(b.since))
+	}
+	b.open, b.failures = false, 0
+}
@@ -1,39 +1,94 @@
 package cache
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/coyove/common/lru"
+	"github.com/coyove/iis/common/metrics"
 	"github.com/gomodule/redigo/redis"
 )
 
+var (
+	cacheGets      = metrics.NewCounter("iis_global_cache_gets_total", "GlobalCache lookups by layer (local or redis)", "layer", "result")
+	cacheBatchSize = metrics.NewHistogram("iis_global_cache_batch_size", "Keys per Redis MGET", []float64{1, 2, 4, 8, 16, 32, 64, 128, 256}, "op")
+)
+
+func countGet(layer string, e *Entry) {
+	switch {
+	case e == nil:
+		cacheGets.Inc(layer, "miss")
+	case e.State == EntryMissing:
+		cacheGets.Inc(layer, "negative")
+	case e.State == EntryWriting:
+		cacheGets.Inc(layer, "writing")
+	default:
+		cacheGets.Inc(layer, "hit")
+	}
+}
+
 type batchGetTask struct {
 	key     string
-	r_value []byte
-	r_ok    bool
+	r_entry *Entry
+	r_err   error
 	done    chan struct{}
 }
 
+const (
+	// DefaultNegativeTTL is how long a missing key is cached, writes replace it anyway
+	DefaultNegativeTTL = time.Minute
+
+	// LockTTL bounds how long a crashed writer can keep readers bypassing the cache
+	LockTTL = 10 * time.Second
+)
+
+// maxDirty limits keys remembered during an outage, see markDirty
+const maxDirty = 1 << 16
+
+var errDegraded = fmt.Errorf("cache: redis circuit open")
+
+// GlobalCache caches values in Redis shared by all instances, or in the local LRU if Redis is not configured.
+// When Redis keeps failing, the circuit opens and the local LRU is used with a short TTL instead,
+// because other instances can't invalidate it.
+// Missing keys are cached as tombstones with a TTL (negative caching).
 type GlobalCache struct {
-	local *lru.Cache
-	c     *redis.Pool
-	batch chan *batchGetTask
+	local       *lru.Cache // *Entry
+	localTTL    time.Duration
+	negativeTTL time.Duration
+	c           *redis.Pool
+	batch       chan *batchGetTask
+	deadline    time.Duration
+	breaker     *breaker
+
+	dirtyMu       sync.Mutex
+	dirty         map[string]bool // keys which may be stale in Redis
+	dirtyOverflow bool
+
+	fault func(k string) bool // see SetFault
 }
 
 type RedisConfig struct {
-	Addr         string        `yaml:"Addr"`
-	Timeout      time.Duration `yaml:"Timeout"`
-	MaxIdle      int           `yaml:"MaxIdle"`
-	BatchWorkers int
+	Addr             string        `yaml:"Addr"`
+	Timeout          time.Duration `yaml:"Timeout"`  // dial, read and write timeout of a connection
+	Deadline         time.Duration `yaml:"Deadline"` // max time Get waits for the batch workers
+	MaxIdle          int           `yaml:"MaxIdle"`
+	FailureThreshold int           `yaml:"FailureThreshold"` // consecutive failures to open the circuit
+	RetryInterval    time.Duration `yaml:"RetryInterval"`    // how often Redis is probed while the circuit is open
+	FallbackTTL      time.Duration `yaml:"FallbackTTL"`      // TTL of local values while the circuit is open
+	NegativeTTL      time.Duration `yaml:"NegativeTTL"`      // TTL of missing keys, default: DefaultNegativeTTL
+	BatchWorkers     int
 }
 
 func NewGlobalCache(localSize int64, config *RedisConfig) *GlobalCache {
 	gc := &GlobalCache{}
 	gc.local = lru.NewCache(localSize)
+	gc.negativeTTL = DefaultNegativeTTL
+	if config != nil && config.NegativeTTL > 0 {
+		gc.negativeTTL = config.NegativeTTL
+	}
 
 	if config != nil && config.Addr != "" && os.Getenv("RC") != "0" {
 		options := []redis.DialOption{}
@@ -46,6 +101,10 @@ func NewGlobalCache(localSize int64, config *RedisConfig) *GlobalCache {
 		options = append(options, redis.DialReadTimeout(config.Timeout))
 		options = append(options, redis.DialWriteTimeout(config.Timeout))
 
+		if config.Deadline == 0 {
+			config.Deadline = config.Timeout * 3
+		}
+
 		if config.MaxIdle == 0 {
 			config.MaxIdle = 10
 		}
@@ -54,11 +113,38 @@ func NewGlobalCache(localSize int64, config *RedisConfig) *GlobalCache {
 			config.BatchWorkers = 1
 		}
 
+		if config.FailureThreshold == 0 {
+			config.FailureThreshold = 5
+		}
+
+		if config.RetryInterval == 0 {
+			config.RetryInterval = time.Second
+		}
+
+		if config.FallbackTTL == 0 {
+			config.FallbackTTL = time.Second * 5
+		}
+
 		gc.c = redis.NewPool(func() (redis.Conn, error) {
 			return redis.Dial("tcp", config.Addr, options...)
 		}, config.MaxIdle)
 
+		gc.localTTL = config.FallbackTTL
+		gc.deadline = config.Deadline
+		gc.breaker = &breaker{threshold: config.FailureThreshold}
+		gc.dirty = map[string]bool{}
 		gc.batch = make(chan *batchGetTask, localSize)
+		metrics.NewGaugeFunc("iis_global_cache_batch_queue", "Lookups waiting for the Redis batch workers", func() float64 {
+			return float64(len(gc.batch))
+		})
+		metrics.NewGaugeFunc("iis_global_cache_degraded", "1 if the Redis circuit is open and the local LRU is used", func() float64 {
+			if gc.breaker.isOpen() {
+				return 1
+			}
+			return 0
+		})
+
+		go gc.heal(config.RetryInterval)
 
 		for i := 0; i < config.BatchWorkers; i++ {
 			go func() {
@@ -96,28 +182,21 @@ func NewGlobalCache(localSize int64, config *RedisConfig) *GlobalCache {
 						keys[i] = tasks[i].key
 					}
 
-					c := gc.c.Get()
-					res, err := redis.Strings(c.Do("MGET", keys...))
-					c.Close()
+					cacheBatchSize.Observe(float64(len(keys)), "batch")
+					res, err := redis.ByteSlices(gc.do("MGET", keys...))
 
 					if err != nil {
-						log.Println("[GlobalCache_redis] batch get:", keys, "error:", err)
+						if err != errDegraded {
+							log.Println("[GlobalCache_redis] batch get:", keys, "error:", err)
+						}
 						for _, t := range tasks {
-							t.r_ok = false
+							t.r_err = err
 							t.done <- struct{}{}
 						}
 					} else {
 						for i, t := range tasks {
-							t.r_value = []byte(res[i])
-
-							if bytes.HasSuffix(t.r_value, []byte("$")) {
-								t.r_value = t.r_value[:len(t.r_value)-1]
-								t.r_ok = true
-							} else {
-								t.r_value = nil
-								t.r_ok = false
-							}
-
+							t.r_entry = parseRedisValue(res[i])
+							countGet("redis", t.r_entry)
 							t.done <- struct{}{}
 						}
 					}
@@ -131,14 +210,131 @@ func NewGlobalCache(localSize int64, config *RedisConfig) *GlobalCache {
 	return gc
 }
 
-func (gc *GlobalCache) Get(k string) ([]byte, bool) {
-	// defer func(a time.Time) {
-	// 	log.Println(time.Since(a))
-	// }(time.Now())
-	if gc.c == nil {
-		v, _ := gc.local.Get(k)
-		p, ok := v.([]byte)
-		return p, ok
+// do runs a Redis command unless the circuit is open, results are reported to the breaker
+func (gc *GlobalCache) do(cmd string, args ...interface{}) (interface{}, error) {
+	if gc.breaker.isOpen() {
+		return nil, errDegraded
+	}
+
+	c := gc.c.Get()
+	defer c.Close()
+
+	res, err := c.Do(cmd, args...)
+	if err != nil {
+		gc.breaker.failure(err)
+	} else {
+		gc.breaker.success()
+	}
+	return res, err
+}
+
+func (gc *GlobalCache) localGet(k string) (*Entry, bool) {
+	v, _ := gc.local.Get(k)
+	e, _ := v.(*Entry)
+	if e != nil && e.Expired(time.Now()) {
+		gc.local.Remove(k)
+		e = nil
+	}
+	countGet("local", e)
+	return e, e != nil
+}
+
+// localPut stores a copy of the entry, which expires after FallbackTTL when Redis is configured
+func (gc *GlobalCache) localPut(k string, e *Entry) {
+	x := *e
+	if gc.localTTL > 0 {
+		if die := time.Now().Add(gc.localTTL).UnixNano(); x.Expire == 0 || die < x.Expire {
+			x.Expire = die
+		}
+	}
+	gc.local.Add(k, &x)
+}
+
+// markDirty remembers keys written without reaching Redis, they are deleted from Redis before the circuit closes
+func (gc *GlobalCache) markDirty(k string) {
+	gc.dirtyMu.Lock()
+	defer gc.dirtyMu.Unlock()
+	if len(gc.dirty) >= maxDirty {
+		if !gc.dirtyOverflow {
+			gc.dirtyOverflow = true
+			log.Println("[GlobalCache_redis] too many keys written during the outage, some may stay stale in Redis")
+		}
+		return
+	}
+	gc.dirty[k] = true
+}
+
+func (gc *GlobalCache) takeDirty() []string {
+	gc.dirtyMu.Lock()
+	defer gc.dirtyMu.Unlock()
+	keys := make([]string, 0, len(gc.dirty))
+	for k := range gc.dirty {
+		keys = append(keys, k)
+	}
+	gc.dirty, gc.dirtyOverflow = map[string]bool{}, false
+	return keys
+}
+
+// heal purges dirty keys from Redis and closes the circuit once Redis is reachable again
+func (gc *GlobalCache) heal(interval time.Duration) {
+	for range time.Tick(interval) {
+		open := gc.breaker.isOpen()
+		keys := gc.takeDirty()
+		if !open && len(keys) == 0 {
+			continue
+		}
+
+		if err := gc.purge(keys); err != nil {
+			for _, k := range keys {
+				gc.markDirty(k)
+			}
+			continue
+		}
+
+		if open {
+			gc.breaker.close()
+			// Keys written between takeDirty and close
+			if keys := gc.takeDirty(); len(keys) > 0 {
+				if err := gc.purge(keys); err != nil {
+					for _, k := range keys {
+						gc.markDirty(k)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (gc *GlobalCache) purge(keys []string) error {
+	c := gc.c.Get()
+	defer c.Close()
+
+	if _, err := c.Do("PING"); err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 256 {
+			n = 256
+		}
+		args := make([]interface{}, n)
+		for i := range args {
+			args[i] = keys[i]
+		}
+		if _, err := c.Do("DEL", args...); err != nil {
+			log.Println("[GlobalCache_redis] purge:", n, "keys, error:", err)
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// Get returns the cached entry, it never waits longer than the deadline for Redis
+func (gc *GlobalCache) Get(k string) (*Entry, bool) {
+	if gc.c == nil || gc.breaker.isOpen() {
+		return gc.localGet(k)
 	}
 
 	task := &batchGetTask{
@@ -146,37 +342,148 @@ func (gc *GlobalCache) Get(k string) ([]byte, bool) {
 		done: make(chan struct{}, 1),
 	}
 
-	gc.batch <- task
-	<-task.done
-	return task.r_value, task.r_ok
+	timer := time.NewTimer(gc.deadline)
+	defer timer.Stop()
+
+	select {
+	case gc.batch <- task:
+	case <-timer.C:
+		gc.breaker.failure(fmt.Errorf("batch queue full"))
+		return gc.localGet(k)
+	}
+
+	select {
+	case <-task.done:
+	case <-timer.C:
+		// The worker will still send to 'done' later, which is buffered
+		gc.breaker.failure(fmt.Errorf("get %q: deadline exceeded", k))
+		return gc.localGet(k)
+	}
+
+	if task.r_err != nil {
+		return gc.localGet(k)
+	}
+	return task.r_entry, task.r_entry != nil
 }
 
-func (gc *GlobalCache) Add(k string, v []byte) error {
-	if gc.c == nil {
-		gc.local.Add(k, v)
+// MultiGet looks up all keys at once, it skips the batch workers and sends MGET directly.
+// Entries are in the same order as keys, nil means a miss.
+func (gc *GlobalCache) MultiGet(keys []string) []*Entry {
+	entries := make([]*Entry, len(keys))
+	if len(keys) == 0 {
+		return entries
+	}
+
+	local := func() []*Entry {
+		for i, k := range keys {
+			entries[i], _ = gc.localGet(k)
+		}
+		return entries
+	}
+
+	if gc.c == nil || gc.breaker.isOpen() {
+		return local()
+	}
+
+	args := make([]interface{}, len(keys))
+	for i := range keys {
+		args[i] = keys[i]
+	}
+
+	cacheBatchSize.Observe(float64(len(keys)), "multi")
+	res, err := redis.ByteSlices(gc.do("MGET", args...))
+
+	if err != nil {
+		if err != errDegraded {
+			log.Println("[GlobalCache_redis] multi get:", len(keys), "keys, error:", err)
+		}
+		return local()
+	}
+
+	for i := range res {
+		entries[i] = parseRedisValue(res[i])
+		countGet("redis", entries[i])
+	}
+	return entries
+}
+
+// parseRedisValue returns nil for missing, expired or corrupted entries
+func parseRedisValue(v []byte) *Entry {
+	if v == nil {
 		return nil
 	}
+	e, err := UnmarshalEntry(v)
+	if err != nil {
+		cacheGets.Inc("redis", "corrupt")
+		return nil
+	}
+	if e.Expired(time.Now()) {
+		return nil
+	}
+	return e
+}
 
-	c := gc.c.Get()
-	defer c.Close()
+// Add caches the value, a nil value caches the key as missing for NegativeTTL
+func (gc *GlobalCache) Add(k string, v []byte) {
+	if v == nil {
+		gc.Put(k, &Entry{State: EntryMissing, Expire: time.Now().Add(gc.negativeTTL).UnixNano()})
+		return
+	}
+	gc.Put(k, &Entry{State: EntryValue, Value: v})
+}
+
+// Lock marks the key as being written until the writer calls Add, Put or Remove, or LockTTL passes
+func (gc *GlobalCache) Lock(k string) {
+	gc.Put(k, &Entry{State: EntryWriting, Expire: time.Now().Add(LockTTL).UnixNano()})
+}
 
-	if _, err := c.Do("SET", k, append(v, '$')); err != nil {
-		log.Println("[GlobalCache_redis] set:", k, "value:", string(v), "error:", err)
-		return fmt.Errorf("cache error")
+// SetFault is for fault injection: Put (and Add) drops the entry if 'drop' returns true. Write locks are kept,
+// so a dropped update after a write leaves the key locked until LockTTL. It must be called before any use.
+func (gc *GlobalCache) SetFault(drop func(k string) bool) {
+	gc.fault = drop
+}
+
+// Put never fails: if Redis is unavailable, the entry is cached locally and the key is deleted from Redis later
+func (gc *GlobalCache) Put(k string, e *Entry) {
+	if gc.fault != nil && e.State != EntryWriting && gc.fault(k) {
+		return
+	}
+
+	if gc.c == nil {
+		gc.localPut(k, e)
+		return
+	}
+
+	gc.local.Remove(k) // left from the last outage
+	args := []interface{}{k, e.Marshal()}
+	if e.Expire > 0 {
+		ttl := e.TTL(time.Now())
+		if ttl < time.Millisecond {
+			gc.Remove(k)
+			return
+		}
+		args = append(args, "PX", int64(ttl/time.Millisecond))
+	}
+
+	if _, err := gc.do("SET", args...); err != nil {
+		if err != errDegraded {
+			log.Println("[GlobalCache_redis] set:", k, "error:", err)
+		}
+		gc.localPut(k, e)
+		gc.markDirty(k)
 	}
-	return nil
 }
 
-// func (gc *GlobalCache) Remove(k string) error {
-// 	if gc.c == nil {
-// 		gc.local.Remove(k)
-// 		return nil
-// 	}
-//
-// 	c := gc.c.Get()
-// 	defer c.Close()
-//
-// 	if _, err := c.Do("DEL", k); err != nil {
-// 	}
-// 	return err
-// }
+func (gc *GlobalCache) Remove(k string) {
+	gc.local.Remove(k)
+	if gc.c == nil {
+		return
+	}
+
+	if _, err := gc.do("DEL", k); err != nil {
+		if err != errDegraded {
+			log.Println("[GlobalCache_redis] del:", k, "error:", err)
+		}
+		gc.markDirty(k)
+	}
+}
@@ -1,43 +1,71 @@
 package cache
 
 import (
+	"bufio"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
-	"unsafe"
 )
 
-func BenchmarkCache(b *testing.B) {
-	c := NewWeakCache(65536, time.Second)
-	p := unsafe.Pointer(new(int))
+func BenchmarkShardedCache(b *testing.B) {
+	c := NewShardedCache(65536, time.Second, 32)
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			k := strconv.Itoa(i & 0xffff)
+			if _, ok := c.Get(k); !ok {
+				c.Add(k, i)
+			}
+		}
+	})
+}
 
-	for i := 0; i < b.N; i++ {
-		c.Add(strconv.Itoa(i), p)
+func TestShardedCache(t *testing.T) {
+	c := NewShardedCache(1000, time.Second*50, 10)
+	if len(c.shards) != 16 {
+		t.Fatal(len(c.shards))
 	}
-}
 
-func TestCache(t *testing.T) {
-	c := NewWeakCache(1<<20, time.Second*50)
+	for i := 0; i < 1e5; i++ {
+		c.Add(strconv.Itoa(i), i)
+	}
+	for i := 0; i < 1e5; i++ {
+		if v, ok := c.Get(strconv.Itoa(i)); ok && v.(int) != i {
+			t.Fatal(i, v)
+		}
+	}
 
-	for i := 0; i < 1e7; i++ {
-		p := new(int)
-		*p = i
-		c.Add(strconv.Itoa(i), unsafe.Pointer(p))
+	st := c.Stats()
+	t.Log(st, st.HitRatio())
+	if st.Len > 1000 || st.Evictions != 1e5-int64(st.Len) || st.Hits != int64(st.Len) {
+		t.Fatal(st)
 	}
 
-	for i := 0; i < 1e7; i++ {
-		p := c.Get(strconv.Itoa(i))
-		if p != nil {
-			if *(*int)(p) != i {
-				t.Fatal(i, *(*int)(p))
-			}
-		}
+	// LRU: a recently used key survives
+	c = NewShardedCache(2, 0, 1)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a")
+	c.Add("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b should be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v.(int) != 1 {
+		t.Fatal(v, ok)
 	}
 
-	t.Log(c.HitRatio())
+	c = NewShardedCache(10, 50*time.Millisecond, 1)
+	c.Add("a", 1)
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Get("a"); ok || c.Stats().Expirations != 1 {
+		t.Fatal("a should expire")
+	}
 }
 
 func BenchmarkReaddirnames(b *testing.B) {
@@ -104,3 +132,176 @@ func TestFGlobal(t *testing.T) {
 	c := NewGlobalCache(100, &RedisConfig{Addr: "devbox0:6379"})
 	t.Log(c.Get("u/zzz"))
 }
+
+// fakeRedis speaks just enough RESP for GlobalCache, it stops replying when 'down' is set
+type fakeRedis struct {
+	mu      sync.Mutex
+	down    bool
+	m       map[string]string
+	deleted []string
+}
+
+func (s *fakeRedis) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+				args := make([]string, n)
+				for i := range args {
+					hdr, _ := r.ReadString('\n')
+					n, _ := strconv.Atoi(strings.TrimSpace(hdr[1:]))
+					arg := make([]byte, n+2)
+					io.ReadFull(r, arg)
+					args[i] = string(arg[:n])
+				}
+
+				s.mu.Lock()
+				if s.down {
+					s.mu.Unlock()
+					continue
+				}
+				var resp string
+				switch strings.ToUpper(args[0]) {
+				case "PING":
+					resp = "+PONG\r\n"
+				case "SET":
+					s.m[args[1]] = args[2]
+					resp = "+OK\r\n"
+				case "DEL":
+					for _, k := range args[1:] {
+						delete(s.m, k)
+					}
+					s.deleted = append(s.deleted, args[1:]...)
+					resp = ":1\r\n"
+				case "MGET":
+					resp = "*" + strconv.Itoa(len(args)-1) + "\r\n"
+					for _, k := range args[1:] {
+						if v, ok := s.m[k]; ok {
+							resp += "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+						} else {
+							resp += "$-1\r\n"
+						}
+					}
+				}
+				s.mu.Unlock()
+				conn.Write([]byte(resp))
+			}
+		}()
+	}
+}
+
+func (s *fakeRedis) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func TestGlobalCacheOutage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := &fakeRedis{m: map[string]string{}}
+	go s.serve(ln)
+
+	c := NewGlobalCache(100, &RedisConfig{
+		Addr:             ln.Addr().String(),
+		Timeout:          20 * time.Millisecond,
+		FailureThreshold: 2,
+		RetryInterval:    50 * time.Millisecond,
+	})
+
+	c.Add("a", []byte("1"))
+	if e, ok := c.Get("a"); !ok || string(e.Value) != "1" {
+		t.Fatal(e, ok)
+	}
+
+	s.setDown(true)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if _, ok := c.Get("a"); ok {
+			t.Fatal("should miss")
+		}
+		if time.Since(start) > 200*time.Millisecond {
+			t.Fatal("Get is not bounded by the deadline:", time.Since(start))
+		}
+	}
+	if !c.breaker.isOpen() {
+		t.Fatal("circuit should be open")
+	}
+
+	// Degraded: the local LRU serves, the write is remembered
+	c.Add("a", []byte("2"))
+	if e, ok := c.Get("a"); !ok || string(e.Value) != "2" {
+		t.Fatal(e, ok)
+	}
+
+	s.setDown(false)
+	time.Sleep(200 * time.Millisecond)
+	if c.breaker.isOpen() {
+		t.Fatal("circuit should be closed")
+	}
+
+	// The stale "1" must have been purged from Redis
+	if e, ok := c.Get("a"); ok {
+		t.Fatal("stale value:", e)
+	}
+
+	// Locked keys are visible to all instances, missing keys expire
+	c.Lock("b")
+	c.Add("c", nil)
+	es := c.MultiGet([]string{"a", "b", "c"})
+	if es[0] != nil || es[1].State != EntryWriting || es[2].State != EntryMissing {
+		t.Fatal(es)
+	}
+	t.Log("purged:", s.deleted)
+}
+
+func TestGlobalCacheNegative(t *testing.T) {
+	c := NewGlobalCache(100, &RedisConfig{NegativeTTL: 50 * time.Millisecond})
+
+	c.Add("a", nil)
+	if e, ok := c.Get("a"); !ok || e.State != EntryMissing {
+		t.Fatal(e, ok)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("negative entry should expire")
+	}
+
+	c.Add("a", []byte("1"))
+	time.Sleep(100 * time.Millisecond)
+	if e, ok := c.Get("a"); !ok || string(e.Value) != "1" {
+		t.Fatal(e, ok)
+	}
+}
+
+func TestEntry(t *testing.T) {
+	e := &Entry{State: EntryValue, Version: 3, Expire: time.Now().Add(time.Hour).UnixNano(), Value: []byte("abc$")}
+	p := e.Marshal()
+	e2, err := UnmarshalEntry(p)
+	if err != nil || e2.Version != 3 || e2.Expire != e.Expire || string(e2.Value) != "abc$" {
+		t.Fatal(e2, err)
+	}
+
+	p[len(p)-1] ^= 1
+	if _, err := UnmarshalEntry(p); err == nil {
+		t.Fatal("checksum should mismatch")
+	}
+	if _, err := UnmarshalEntry([]byte("legacy$")); err == nil {
+		t.Fatal("legacy value should be rejected")
+	}
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+type EntryState byte
+
+const (
+	EntryValue   EntryState = iota // the key exists, Value may still be empty
+	EntryMissing                   // tombstone: the key doesn't exist in the backend
+	EntryWriting                   // a write is in progress, readers must bypass the cache
+)
+
+// Entry is what GlobalCache stores, both in Redis and in the local LRU
+type Entry struct {
+	State   EntryState
+	Version uint64 // version in the backend, 0 if unknown
+	Expire  int64  // unix nano, 0 means never
+	Value   []byte
+}
+
+// Encoded entries: magic(2) format(1) state(1) version(8) expire(8) crc32(4) value,
+// the checksum covers the header and the value.
+var entryMagic = [2]byte{0xfd, 'C'}
+
+const (
+	entryFormat    = 1
+	entryHeaderLen = 24
+)
+
+func (e *Entry) Expired(now time.Time) bool {
+	return e.Expire > 0 && now.UnixNano() >= e.Expire
+}
+
+// TTL returns the time left before expiry, 0 if the entry never expires
+func (e *Entry) TTL(now time.Time) time.Duration {
+	if e.Expire == 0 {
+		return 0
+	}
+	return time.Duration(e.Expire - now.UnixNano())
+}
+
+func (e *Entry) Marshal() []byte {
+	p := make([]byte, entryHeaderLen+len(e.Value))
+	p[0], p[1], p[2], p[3] = entryMagic[0], entryMagic[1], entryFormat, byte(e.State)
+	binary.BigEndian.PutUint64(p[4:], e.Version)
+	binary.BigEndian.PutUint64(p[12:], uint64(e.Expire))
+	copy(p[entryHeaderLen:], e.Value)
+	binary.BigEndian.PutUint32(p[20:], entryChecksum(p))
+	return p
+}
+
+func entryChecksum(p []byte) uint32 {
+	h := crc32.NewIEEE()
+	h.Write(p[:20])
+	h.Write(p[entryHeaderLen:])
+	return h.Sum32()
+}
+
+func UnmarshalEntry(p []byte) (*Entry, error) {
+	if len(p) < entryHeaderLen || p[0] != entryMagic[0] || p[1] != entryMagic[1] {
+		return nil, fmt.Errorf("cache entry: invalid header")
+	}
+	if p[2] != entryFormat {
+		return nil, fmt.Errorf("cache entry: unknown format %d", p[2])
+	}
+	if binary.BigEndian.Uint32(p[20:]) != entryChecksum(p) {
+		return nil, fmt.Errorf("cache entry: checksum mismatch")
+	}
+
+	e := &Entry{
+		State:   EntryState(p[3]),
+		Version: binary.BigEndian.Uint64(p[4:]),
+		Expire:  int64(binary.BigEndian.Uint64(p[12:])),
+	}
+	if e.State > EntryWriting {
+		return nil, fmt.Errorf("cache entry: unknown state %d", e.State)
+	}
+	if e.State == EntryValue {
+		e.Value = p[entryHeaderLen:]
+	}
+	return e, nil
+}
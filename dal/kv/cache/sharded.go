@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/iis/common"
+)
+
+// ShardedCache is an in-process LRU cache with TTL, keys are spread over shards to reduce lock contention.
+// Values are interface{}, wrap the cache with typed Get/Add methods instead of asserting types at every call site.
+type ShardedCache struct {
+	shards []*cacheShard
+	ttl    time.Duration
+
+	hits, misses, evictions, expirations int64
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	lru      *list.List // front is the most recently used
+}
+
+type cacheItem struct {
+	key   string
+	value interface{}
+	die   int64
+}
+
+type ShardedCacheStats struct {
+	Len         int
+	Hits        int64
+	Misses      int64
+	Evictions   int64 // removed because the shard was full
+	Expirations int64 // removed because the TTL passed
+}
+
+func (s ShardedCacheStats) HitRatio() float64 {
+	return float64(s.Hits) / (float64(s.Hits) + float64(s.Misses) + 1)
+}
+
+// NewShardedCache creates a cache holding at most 'capacity' items, evicting the least recently used ones.
+// Items expire after 'ttl', 0 means never. 'shards' is rounded up to a power of 2.
+func NewShardedCache(capacity int, ttl time.Duration, shards int) *ShardedCache {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	per := capacity / n
+	if per < 1 {
+		per = 1
+	}
+
+	c := &ShardedCache{
+		shards: make([]*cacheShard, n),
+		ttl:    ttl,
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			capacity: per,
+			items:    map[string]*list.Element{},
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+func (c *ShardedCache) shard(key string) *cacheShard {
+	return c.shards[common.Hash32(key)&uint32(len(c.shards)-1)]
+}
+
+func (c *ShardedCache) Get(key string) (interface{}, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.items[key]
+	if e == nil {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	it := e.Value.(*cacheItem)
+	if it.die > 0 && time.Now().UnixNano() >= it.die {
+		s.remove(e)
+		atomic.AddInt64(&c.expirations, 1)
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	s.lru.MoveToFront(e)
+	atomic.AddInt64(&c.hits, 1)
+	return it.value, true
+}
+
+func (c *ShardedCache) Add(key string, value interface{}) {
+	var die int64
+	if c.ttl > 0 {
+		die = time.Now().Add(c.ttl).UnixNano()
+	}
+
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e := s.items[key]; e != nil {
+		it := e.Value.(*cacheItem)
+		it.value, it.die = value, die
+		s.lru.MoveToFront(e)
+		return
+	}
+
+	s.items[key] = s.lru.PushFront(&cacheItem{key: key, value: value, die: die})
+	for s.lru.Len() > s.capacity {
+		s.remove(s.lru.Back())
+		atomic.AddInt64(&c.evictions, 1)
+	}
+}
+
+func (c *ShardedCache) Delete(key string) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.items[key]; e != nil {
+		s.remove(e)
+	}
+}
+
+func (s *cacheShard) remove(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.items, e.Value.(*cacheItem).key)
+}
+
+func (c *ShardedCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+func (c *ShardedCache) Stats() ShardedCacheStats {
+	return ShardedCacheStats{
+		Len:         c.Len(),
+		Hits:        atomic.LoadInt64(&c.hits),
+		Misses:      atomic.LoadInt64(&c.misses),
+		Evictions:   atomic.LoadInt64(&c.evictions),
+		Expirations: atomic.LoadInt64(&c.expirations),
+	}
+}
@@ -0,0 +1,399 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DynamoChunkSize keeps chunks under the 400 KB item limit of DynamoDB, leaving room for the key and attribute names
+const DynamoChunkSize = 350 << 10
+
+// Like compressMagic, 0xff never appears in UTF-8 text
+var chunkMagic = []byte{0xff, 'c'}
+
+// Chunk keys are "\x01c/<key>/<generation>/<index>", they never collide with dal keys and are hidden from Scan
+const chunkPrefix = "\x01c/"
+
+const chunkReadRetries = 3
+
+// ChunkKV splits values larger than 'size' into chunk keys and stores a manifest under the key itself:
+//
+//	magic (2) | uvarint len(gen) | gen | uvarint n | uvarint total length | crc32 (4, big endian) of the value
+//
+// Chunks are written under a new generation before the manifest, so readers see either the old or the new value,
+// and versions are the manifest's. Chunks of the old generation are deleted afterwards, the old manifest is
+// read from the (cached) Get to keep writes cheap, so a stale cache or a crash may leave orphans, see Vacuum.
+type ChunkKV struct {
+	KeyValueOp
+	size int
+}
+
+type chunkManifest struct {
+	gen   string
+	n     int
+	total int
+	sum   uint32
+}
+
+func NewChunkKV(db KeyValueOp, size int) *ChunkKV {
+	return &ChunkKV{
+		KeyValueOp: db,
+		size:       size,
+	}
+}
+
+func chunkKey(key, gen string, i int) string {
+	return chunkPrefix + key + "/" + gen + "/" + strconv.Itoa(i)
+}
+
+// parseChunkKey returns the key and the generation of a chunk key
+func parseChunkKey(ck string) (key, gen string, ok bool) {
+	p := strings.Split(strings.TrimPrefix(ck, chunkPrefix), "/")
+	if !strings.HasPrefix(ck, chunkPrefix) || len(p) < 3 {
+		return "", "", false
+	}
+	return strings.Join(p[:len(p)-2], "/"), p[len(p)-2], true
+}
+
+// newChunkGen returns a unique generation starting with the creation time, so Vacuum can tell its age
+func newChunkGen() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.FormatUint(uint64(rand.Uint32()), 36)
+}
+
+func chunkGenTime(gen string) time.Time {
+	ts, _ := strconv.ParseInt(strings.SplitN(gen, ".", 2)[0], 36, 64)
+	return time.Unix(0, ts)
+}
+
+func (c *chunkManifest) keys(key string) []string {
+	keys := make([]string, c.n)
+	for i := range keys {
+		keys[i] = chunkKey(key, c.gen, i)
+	}
+	return keys
+}
+
+func (c *chunkManifest) marshal() []byte {
+	buf := bytes.NewBuffer(append([]byte{}, chunkMagic...))
+	writeUvarint(buf, uint64(len(c.gen)))
+	buf.WriteString(c.gen)
+	writeUvarint(buf, uint64(c.n))
+	writeUvarint(buf, uint64(c.total))
+	binary.Write(buf, binary.BigEndian, c.sum)
+	return buf.Bytes()
+}
+
+// parseChunkManifest returns nil if the value is not a manifest
+func parseChunkManifest(v []byte) (*chunkManifest, error) {
+	if !bytes.HasPrefix(v, chunkMagic) {
+		return nil, nil
+	}
+	rd := bytes.NewReader(v[len(chunkMagic):])
+	c := &chunkManifest{}
+	n, err := binary.ReadUvarint(rd)
+	if err != nil || n > uint64(rd.Len()) {
+		return nil, fmt.Errorf("chunk: invalid manifest")
+	}
+	gen := make([]byte, n)
+	rd.Read(gen)
+	c.gen = string(gen)
+
+	cn, err1 := binary.ReadUvarint(rd)
+	total, err2 := binary.ReadUvarint(rd)
+	err3 := binary.Read(rd, binary.BigEndian, &c.sum)
+	if err1 != nil || err2 != nil || err3 != nil || cn > 1<<20 {
+		return nil, fmt.Errorf("chunk: invalid manifest")
+	}
+	c.n, c.total = int(cn), int(total)
+	return c, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+// needChunks also chunks small values which look like manifests
+func (m *ChunkKV) needChunks(v []byte) bool {
+	return len(v) > m.size || bytes.HasPrefix(v, chunkMagic)
+}
+
+// writeChunks stores the value under a new generation and returns the manifest to write
+func (m *ChunkKV) writeChunks(key string, value []byte) (*chunkManifest, error) {
+	c := &chunkManifest{
+		gen:   newChunkGen(),
+		n:     (len(value) + m.size - 1) / m.size,
+		total: len(value),
+		sum:   crc32.ChecksumIEEE(value),
+	}
+	for i, ck := range c.keys(key) {
+		end := (i + 1) * m.size
+		if end > len(value) {
+			end = len(value)
+		}
+		if err := m.KeyValueOp.Set(ck, value[i*m.size:end]); err != nil {
+			m.deleteChunks(key, c)
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (m *ChunkKV) deleteChunks(key string, c *chunkManifest) {
+	if c == nil {
+		return
+	}
+	for _, ck := range c.keys(key) {
+		if err := m.KeyValueOp.Delete(ck); err != nil {
+			log.Println("[ChunkKV] delete chunk:", ck, err)
+		}
+	}
+}
+
+// oldManifest is best effort, a missed manifest only leaves orphans
+func (m *ChunkKV) oldManifest(key string) *chunkManifest {
+	v, err := m.KeyValueOp.Get(key)
+	if err != nil {
+		return nil
+	}
+	c, _ := parseChunkManifest(v)
+	return c
+}
+
+// resolve reassembles the values of manifests in 'values' in place, returning the keys whose chunks are gone
+func (m *ChunkKV) resolve(keys []string, values [][]byte) ([]int, error) {
+	idx, manifests, cks := []int{}, []*chunkManifest{}, []string{}
+	for i, v := range values {
+		c, err := parseChunkManifest(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keys[i], err)
+		}
+		if c != nil {
+			idx, manifests, cks = append(idx, i), append(manifests, c), append(cks, c.keys(keys[i])...)
+		}
+	}
+	if len(idx) == 0 {
+		return nil, nil
+	}
+
+	chunks, err := m.KeyValueOp.MultiGet(cks)
+	if err != nil {
+		return nil, err
+	}
+
+	gone := []int{}
+	for j, c := range manifests {
+		i, buf := idx[j], make([]byte, 0, c.total)
+		complete := true
+		for _, p := range chunks[:c.n] {
+			if p == nil {
+				complete = false
+			}
+			buf = append(buf, p...)
+		}
+		chunks = chunks[c.n:]
+
+		switch {
+		case !complete:
+			// Overwritten by a concurrent writer, the caller reads the key again
+			gone = append(gone, i)
+		case len(buf) != c.total || crc32.ChecksumIEEE(buf) != c.sum:
+			return nil, fmt.Errorf("%s: chunk: checksum mismatch", keys[i])
+		default:
+			values[i] = buf
+		}
+	}
+	return gone, nil
+}
+
+func (m *ChunkKV) Get(key string) ([]byte, error) {
+	v, _, err := m.get(key, false)
+	return v, err
+}
+
+func (m *ChunkKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	return m.get(key, true)
+}
+
+func (m *ChunkKV) get(key string, withVersion bool) ([]byte, uint64, error) {
+	for retry := 0; ; retry++ {
+		var v []byte
+		var ver uint64
+		var err error
+		if withVersion {
+			v, ver, err = m.KeyValueOp.GetWithVersion(key)
+		} else {
+			v, err = m.KeyValueOp.Get(key)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		values := [][]byte{v}
+		gone, err := m.resolve([]string{key}, values)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(gone) == 0 {
+			return values[0], ver, nil
+		}
+		if retry >= chunkReadRetries {
+			return nil, 0, fmt.Errorf("%s: chunk: missing chunks", key)
+		}
+	}
+}
+
+func (m *ChunkKV) MultiGet(keys []string) ([][]byte, error) {
+	res, err := m.KeyValueOp.MultiGet(keys)
+	if err != nil {
+		return nil, err
+	}
+	gone, err := m.resolve(keys, res)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range gone {
+		if res[i], err = m.Get(keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (m *ChunkKV) Set(key string, value []byte) error {
+	old := m.oldManifest(key)
+	if !m.needChunks(value) {
+		if err := m.KeyValueOp.Set(key, value); err != nil {
+			return err
+		}
+		m.deleteChunks(key, old)
+		return nil
+	}
+
+	c, err := m.writeChunks(key, value)
+	if err != nil {
+		return err
+	}
+	if err := m.KeyValueOp.Set(key, c.marshal()); err != nil {
+		m.deleteChunks(key, c)
+		return err
+	}
+	m.deleteChunks(key, old)
+	return nil
+}
+
+func (m *ChunkKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	old := m.oldManifest(key)
+	if !m.needChunks(value) {
+		if err := m.KeyValueOp.CompareAndSet(key, value, ver); err != nil {
+			return err
+		}
+		m.deleteChunks(key, old)
+		return nil
+	}
+
+	c, err := m.writeChunks(key, value)
+	if err != nil {
+		return err
+	}
+	if err := m.KeyValueOp.CompareAndSet(key, c.marshal(), ver); err != nil {
+		m.deleteChunks(key, c)
+		return err
+	}
+	m.deleteChunks(key, old)
+	return nil
+}
+
+func (m *ChunkKV) Delete(key string) error {
+	old := m.oldManifest(key)
+	if err := m.KeyValueOp.Delete(key); err != nil {
+		return err
+	}
+	m.deleteChunks(key, old)
+	return nil
+}
+
+func (m *ChunkKV) CompareAndDelete(key string, ver uint64) error {
+	old := m.oldManifest(key)
+	if err := m.KeyValueOp.CompareAndDelete(key, ver); err != nil {
+		return err
+	}
+	m.deleteChunks(key, old)
+	return nil
+}
+
+// Scan hides chunk keys and reassembles values
+func (m *ChunkKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	res, next, err := m.KeyValueOp.Scan(prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	pairs, keys, values := res[:0], []string{}, [][]byte{}
+	for _, p := range res {
+		if !strings.HasPrefix(p.Key, chunkPrefix) {
+			pairs = append(pairs, p)
+			keys, values = append(keys, p.Key), append(values, p.Value)
+		}
+	}
+	gone, err := m.resolve(keys, values)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, i := range gone {
+		if values[i], err = m.Get(keys[i]); err != nil {
+			return nil, "", err
+		}
+	}
+	for i := range pairs {
+		pairs[i].Value = values[i]
+	}
+	return pairs, next, nil
+}
+
+// Vacuum deletes chunks not referenced by their manifests, chunks younger than 'age' may belong to writes
+// in progress and are kept. It scans chunk keys only, but some backends (DynamoDB) still read the whole table.
+func (m *ChunkKV) Vacuum(age time.Duration) (scanned, deleted int, err error) {
+	live := map[string]string{} // key -> generation of its manifest
+	for cursor := ""; ; {
+		res, next, err := m.KeyValueOp.Scan(chunkPrefix, cursor, 1000)
+		if err != nil {
+			return scanned, deleted, err
+		}
+		for _, p := range res {
+			scanned++
+			key, gen, ok := parseChunkKey(p.Key)
+			if !ok || time.Since(chunkGenTime(gen)) < age {
+				continue
+			}
+			if _, ok := live[key]; !ok {
+				v, _, err := m.KeyValueOp.GetWithVersion(key)
+				if err != nil {
+					return scanned, deleted, err
+				}
+				live[key] = ""
+				if c, _ := parseChunkManifest(v); c != nil {
+					live[key] = c.gen
+				}
+			}
+			if live[key] == gen {
+				continue
+			}
+			if err := m.KeyValueOp.Delete(p.Key); err != nil {
+				return scanned, deleted, err
+			}
+			deleted++
+		}
+		if next == "" {
+			return scanned, deleted, nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,99 @@
+package kv
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustScan(t *testing.T, db KeyValueOp, prefix string) []Pair {
+	res, _, err := db.Scan(prefix, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func countChunks(t *testing.T, db KeyValueOp) int {
+	return len(mustScan(t, db, chunkPrefix))
+}
+
+func TestChunkKV(t *testing.T) {
+	mem, _ := NewMemoryKV("")
+	db := NewChunkKV(mem, 100)
+
+	big := make([]byte, 1050)
+	rand.Read(big)
+	if err := db.Set("a/b", big); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, mem); n != 11 {
+		t.Fatal(n)
+	}
+	v, ver, err := db.GetWithVersion("a/b")
+	if err != nil || !bytes.Equal(v, big) {
+		t.Fatal(len(v), err)
+	}
+
+	// Overwriting deletes chunks of the old generation, a failed CAS deletes its own chunks
+	big2 := bytes.Repeat([]byte("x"), 250)
+	if err := db.CompareAndSet("a/b", big2, ver); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSet("a/b", big, ver); err != ErrConflict {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, mem); n != 3 {
+		t.Fatal(n)
+	}
+
+	db.Set("small", []byte("1"))
+	db.Set("magic", chunkMagic)
+	vs, err := db.MultiGet([]string{"small", "a/b", "missing", "magic"})
+	if err != nil || string(vs[0]) != "1" || !bytes.Equal(vs[1], big2) || vs[2] != nil || !bytes.Equal(vs[3], chunkMagic) {
+		t.Fatal(vs, err)
+	}
+
+	res, _, _ := db.Scan("", "", 0)
+	for _, p := range res {
+		if strings.HasPrefix(p.Key, chunkPrefix) {
+			t.Fatal(p.Key)
+		}
+	}
+	if len(res) != 3 || !bytes.Equal(res[0].Value, big2) {
+		t.Fatal(res)
+	}
+
+	db.Set("a/b", []byte("small now"))
+	if n := countChunks(t, mem); n != 1 {
+		t.Fatal(n)
+	}
+
+	// Left by a crash
+	mem.Set(chunkKey("a/b", newChunkGen(), 0), []byte("x"))
+	if _, deleted, _ := db.Vacuum(time.Hour); deleted != 0 {
+		t.Fatal(deleted)
+	}
+	if scanned, deleted, _ := db.Vacuum(0); scanned != 2 || deleted != 1 {
+		t.Fatal(scanned, deleted)
+	}
+	if v, _ := db.Get("magic"); !bytes.Equal(v, chunkMagic) {
+		t.Fatal(v)
+	}
+
+	db.Delete("magic")
+	if n := countChunks(t, mem); n != 0 {
+		t.Fatal(n)
+	}
+
+	// Chunks are gone, e.g. deleted by a concurrent writer
+	db.Set("c", big)
+	for _, p := range mustScan(t, mem, chunkPrefix) {
+		mem.Delete(p.Key)
+	}
+	if _, err := db.Get("c"); err == nil {
+		t.Fatal("missing chunks")
+	}
+}
@@ -1,5 +1,50 @@
 package kv
 
-var randomError = 0
+import (
+	"errors"
+	"sort"
+	"strings"
 
-var locker = []byte("2e92a123-2979-4d57-8670-7db486f79096")
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+type KeyValueOp interface {
+	Get(string) ([]byte, error)
+	MultiGet([]string) ([][]byte, error)
+	GetWithVersion(string) ([]byte, uint64, error)
+	Set(string, []byte) error
+	CompareAndSet(string, []byte, uint64) error
+	// Delete removes the key and invalidates caches. dal never deletes chain nodes (articles, follow, block
+	// and like records), which are linked from their previous nodes and stay as tombstones or "false" states,
+	// it is used for standalone keys: the mod KV editor, archiving and restoring deletions.
+	Delete(string) error
+	// CompareAndDelete deletes the key only if its version equals 'ver', otherwise ErrConflict is returned
+	CompareAndDelete(string, uint64) error
+	Scan(prefix, cursor string, limit int) ([]Pair, string, error)
+	SetGlobalCache(*cache.GlobalCache)
+}
+
+// ErrConflict is returned by CompareAndSet when the stored version doesn't match
+var ErrConflict = errors.New("version conflict")
+
+// Pair is a key-value pair returned by Scan
+type Pair struct {
+	Key   string
+	Value []byte
+}
+
+// scanKeys sorts keys with the given prefix and returns at most 'limit' ones after 'cursor',
+// 'next' will be empty if there are no more keys.
+func scanKeys(keys []string, prefix, cursor string, limit int) (page []string, next string) {
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) && k > cursor {
+			page = append(page, k)
+		}
+	}
+	sort.Strings(page)
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+		next = page[limit-1]
+	}
+	return
+}
@@ -0,0 +1,119 @@
+package kv
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Compressed values start with 0xff which never appears in UTF-8 text (JSON),
+// so values written before compression was enabled can still be read as is.
+var compressMagic = []byte{0xff, 'z'}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// CompressKV compresses values larger than the threshold before passing them to the backend,
+// which means GlobalCache (living inside the backend) holds compressed values too.
+type CompressKV struct {
+	KeyValueOp
+	threshold int
+}
+
+func NewCompressKV(db KeyValueOp, threshold int) *CompressKV {
+	return &CompressKV{
+		KeyValueOp: db,
+		threshold:  threshold,
+	}
+}
+
+func Compress(v []byte) []byte {
+	buf := bytes.NewBuffer(append([]byte{}, compressMagic...))
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(buf)
+	w.Write(v)
+	w.Close()
+	flateWriters.Put(w)
+	return buf.Bytes()
+}
+
+// Decompress returns the value as is if it is not compressed
+func Decompress(v []byte) ([]byte, error) {
+	if !bytes.HasPrefix(v, compressMagic) {
+		return v, nil
+	}
+	r := flate.NewReader(bytes.NewReader(v[len(compressMagic):]))
+	defer r.Close()
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %v", err)
+	}
+	return p, nil
+}
+
+func (m *CompressKV) compress(v []byte) []byte {
+	if len(v) < m.threshold {
+		return v
+	}
+	if c := Compress(v); len(c) < len(v) {
+		return c
+	}
+	return v
+}
+
+func (m *CompressKV) Get(key string) ([]byte, error) {
+	v, err := m.KeyValueOp.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return Decompress(v)
+}
+
+func (m *CompressKV) MultiGet(keys []string) ([][]byte, error) {
+	res, err := m.KeyValueOp.MultiGet(keys)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		if res[i], err = Decompress(res[i]); err != nil {
+			return nil, fmt.Errorf("%s: %v", keys[i], err)
+		}
+	}
+	return res, nil
+}
+
+func (m *CompressKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	v, ver, err := m.KeyValueOp.GetWithVersion(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	v, err = Decompress(v)
+	return v, ver, err
+}
+
+func (m *CompressKV) Set(key string, value []byte) error {
+	return m.KeyValueOp.Set(key, m.compress(value))
+}
+
+func (m *CompressKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	return m.KeyValueOp.CompareAndSet(key, m.compress(value), ver)
+}
+
+func (m *CompressKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	res, next, err := m.KeyValueOp.Scan(prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range res {
+		if res[i].Value, err = Decompress(res[i].Value); err != nil {
+			return nil, "", fmt.Errorf("%s: %v", res[i].Key, err)
+		}
+	}
+	return res, next, nil
+}
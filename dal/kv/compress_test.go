@@ -0,0 +1,29 @@
+package kv
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressKV(t *testing.T) {
+	db, _ := NewMemoryKV("")
+	m := NewCompressKV(db, 64)
+
+	small, big := []byte(`{"id":"a"}`), []byte(`{"id":"b","content":"`+strings.Repeat("hello", 100)+`"}`)
+	m.Set("small", small)
+	m.Set("big", big)
+	db.Set("legacy", big)
+
+	if v, _ := db.Get("small"); !bytes.Equal(v, small) {
+		t.Fatal(v)
+	}
+	if v, _ := db.Get("big"); !bytes.HasPrefix(v, compressMagic) || len(v) >= len(big) {
+		t.Fatal(v)
+	}
+
+	res, _ := m.MultiGet([]string{"small", "big", "legacy", "missing"})
+	if !bytes.Equal(res[0], small) || !bytes.Equal(res[1], big) || !bytes.Equal(res[2], big) || res[3] != nil {
+		t.Fatal(res)
+	}
+}
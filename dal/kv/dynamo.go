@@ -1,49 +1,178 @@
 package kv
 
 import (
-	"bytes"
+	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/coyove/iis/common/metrics"
 	"github.com/coyove/iis/dal/kv/cache"
 	//sync "github.com/sasha-s/go-deadlock"
 )
 
-var dyTable = "iis"
+const dyBatchGetLimit = 100
+
+var dyThrottled = metrics.NewCounter("iis_dynamo_throttled_total", "DynamoDB requests rejected for exceeding the throughput", "op")
 
 type DynamoKV struct {
-	cache *cache.GlobalCache
-	db    *dynamodb.DynamoDB
+	cache  *cache.GlobalCache
+	db     *dynamodb.DynamoDB
+	table  string
+	retry  dyRetryer
+	flight flightGroup
+}
+
+type DynamoConfig struct {
+	Region      string
+	AccessKey   string
+	SecretKey   string
+	Table       string        // default: iis
+	Endpoint    string        // e.g. http://127.0.0.1:8000 for DynamoDB Local, default: the endpoint of the region
+	Timeout     time.Duration // of HTTP requests, default: 1s
+	MaxConns    int           // per host, default: 200
+	Retries     int           // max retries of throttled or failed requests, default: 5
+	RetryBase   time.Duration // the backoff doubles after each retry, up to RetryMax, default: 50ms
+	RetryMax    time.Duration // default: 2s
+	CreateTable bool          // create the table (on-demand capacity) if it doesn't exist
 }
 
-func NewDynamoKV(region, accessKey, secretKey string) *DynamoKV {
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
+// dyRetryer backs off exponentially with full jitter, throttling is counted and always retried
+type dyRetryer struct {
+	retries   int
+	base, max time.Duration
+}
+
+func (r dyRetryer) MaxRetries() int {
+	return r.retries
+}
+
+func (r dyRetryer) ShouldRetry(req *request.Request) bool {
+	if req.IsErrorThrottle() {
+		dyThrottled.Inc(req.Operation.Name)
+		return true
+	}
+	return req.IsErrorRetryable()
+}
+
+func (r dyRetryer) RetryRules(req *request.Request) time.Duration {
+	return r.backoff(req.RetryCount)
+}
+
+func (r dyRetryer) backoff(retry int) time.Duration {
+	d := r.max
+	if retry < 30 && r.base<<uint(retry) < r.max {
+		d = r.base << uint(retry)
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func NewDynamoKV(c DynamoConfig) (*DynamoKV, error) {
+	if c.Table == "" {
+		c.Table = "iis"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Second
+	}
+	if c.MaxConns == 0 {
+		c.MaxConns = 200
+	}
+	if c.Retries == 0 {
+		c.Retries = 5
+	}
+	if c.RetryBase == 0 {
+		c.RetryBase = 50 * time.Millisecond
+	}
+	if c.RetryMax == 0 {
+		c.RetryMax = 2 * time.Second
+	}
+
+	retry := dyRetryer{retries: c.Retries, base: c.RetryBase, max: c.RetryMax}
+	cfg := &aws.Config{
+		Region:      aws.String(c.Region),
+		Credentials: credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, ""),
+		// Let dyRetryer decide (and count throttling) for every error
+		EnforceShouldRetryCheck: aws.Bool(true),
 		HTTPClient: &http.Client{
-			Timeout: time.Second,
+			Timeout: c.Timeout,
 			Transport: &http.Transport{
-				MaxConnsPerHost: 200,
+				MaxConnsPerHost: c.MaxConns,
 			},
 		},
-	})
-	if err != nil {
-		panic(err)
 	}
-	db := dynamodb.New(sess)
-	_, err = db.DescribeEndpoints(&dynamodb.DescribeEndpointsInput{})
+	if c.Endpoint != "" {
+		cfg.Endpoint = aws.String(c.Endpoint)
+	}
+	sess, err := session.NewSession(request.WithRetryer(cfg, retry))
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	m := &DynamoKV{
+		db:     dynamodb.New(sess),
+		table:  c.Table,
+		retry:  retry,
+		flight: flightGroup{name: "dynamo"},
+	}
+	if err := m.checkTable(c.CreateTable); err != nil {
+		return nil, fmt.Errorf("dynamo: table %s: %v", c.Table, err)
+	}
+	return m, nil
+}
+
+// checkTable makes sure the table exists, it is created with "id" as the hash key if 'create' is true
+func (m *DynamoKV) checkTable(create bool) error {
+	in := &dynamodb.DescribeTableInput{TableName: &m.table}
+	_, err := m.db.DescribeTable(in)
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException || !create {
+		return err
+	}
+
+	log.Println("[DynamoKV] creating table", m.table)
+	if _, err := m.db.CreateTable(&dynamodb.CreateTableInput{
+		TableName:   &m.table,
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+	}); err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			return err
+		}
+		// Created by another instance
+	}
+	return m.db.WaitUntilTableExists(in)
+}
+
+// dyAttr stores UTF-8 values as strings, others (compressed or binary encoded values) as binaries
+func dyAttr(value []byte) *dynamodb.AttributeValue {
+	if utf8.Valid(value) {
+		return &dynamodb.AttributeValue{S: aws.String(string(value))}
+	}
+	return &dynamodb.AttributeValue{B: value}
+}
+
+func dyValue(item map[string]*dynamodb.AttributeValue) []byte {
+	vi := item["value"]
+	if vi == nil {
+		return nil
 	}
-	r := &DynamoKV{
-		db: db,
+	if vi.S != nil {
+		return []byte(*vi.S)
 	}
-	return r
+	return vi.B
 }
 
 func (m *DynamoKV) SetGlobalCache(c *cache.GlobalCache) {
@@ -51,19 +180,33 @@ func (m *DynamoKV) SetGlobalCache(c *cache.GlobalCache) {
 }
 
 func (m *DynamoKV) Get(key string) ([]byte, error) {
-	nocache := false
+	v, _, err := m.getCached(key)
+	return v, err
+}
 
-	v, ok := m.cache.Get(key)
-	if bytes.Equal(v, locker) {
-		v = nil
-		nocache = true
-		// continue fetching value from dynamodb
+func (m *DynamoKV) getCached(key string) ([]byte, bool, error) {
+	e, ok := m.cache.Get(key)
+	if ok && e.State == cache.EntryWriting {
+		// A write is in progress, fetch the value from dynamodb without caching or coalescing
+		v, err := m.get(key)
+		return v, false, err
 	} else if ok {
-		return v, nil
+		return e.Value, true, nil
 	}
 
+	v, err := m.flight.Do(key, func() ([]byte, error) {
+		v, err := m.get(key)
+		if err == nil {
+			m.cache.Add(key, v)
+		}
+		return v, err
+	})
+	return v, false, err
+}
+
+func (m *DynamoKV) get(key string) ([]byte, error) {
 	in := &dynamodb.GetItemInput{
-		TableName: &dyTable,
+		TableName: &m.table,
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": &dynamodb.AttributeValue{
 				S: &key,
@@ -75,40 +218,172 @@ func (m *DynamoKV) Get(key string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return dyValue(out.Item), nil
+}
+
+// MultiGet returns values in the same order as keys, missing keys get nil values
+func (m *DynamoKV) MultiGet(keys []string) ([][]byte, error) {
+	res, _, err := m.multiGetCached(keys)
+	return res, err
+}
+
+func (m *DynamoKV) multiGetCached(keys []string) ([][]byte, bool, error) {
+	res := make([][]byte, len(keys))
+	cached := m.cache.MultiGet(keys)
+
+	missing := map[string][]int{}
+	nocache := map[string]bool{}
+	pending := []string{}
+
+	for i, key := range keys {
+		if e := cached[i]; e != nil && e.State == cache.EntryWriting {
+			nocache[key] = true
+		} else if e != nil {
+			res[i] = e.Value
+			continue
+		}
+		if _, ok := missing[key]; !ok {
+			pending = append(pending, key)
+		}
+		missing[key] = append(missing[key], i)
+	}
+
+	hit := len(pending) == 0
+	fetched := map[string][]byte{}
+	for retry := 0; len(pending) > 0; {
+		batch := pending
+		if len(batch) > dyBatchGetLimit {
+			batch = batch[:dyBatchGetLimit]
+		}
+		pending = pending[len(batch):]
+
+		ka := &dynamodb.KeysAndAttributes{}
+		for i := range batch {
+			ka.Keys = append(ka.Keys, map[string]*dynamodb.AttributeValue{
+				"id": &dynamodb.AttributeValue{
+					S: &batch[i],
+				},
+			})
+		}
 
-	if vi := out.Item["value"]; vi != nil && vi.S != nil {
-		v = []byte(*vi.S)
+		out, err := m.db.BatchGetItem(&dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{m.table: ka},
+		})
+		if err != nil {
+			return nil, false, err
+		}
+
+		for _, item := range out.Responses[m.table] {
+			if id := item["id"]; id != nil && id.S != nil {
+				if v := dyValue(item); v != nil {
+					fetched[*id.S] = v
+				}
+			}
+		}
+
+		if uk := out.UnprocessedKeys[m.table]; uk != nil && len(uk.Keys) > 0 {
+			dyThrottled.Inc("BatchGetItem")
+			if retry++; retry > m.retry.retries {
+				return nil, false, fmt.Errorf("batch get: too many unprocessed keys")
+			}
+			for _, k := range uk.Keys {
+				if id := k["id"]; id != nil && id.S != nil {
+					pending = append(pending, *id.S)
+				}
+			}
+			time.Sleep(m.retry.backoff(retry))
+		}
 	}
 
-	if !nocache {
-		if err := m.cache.Add(key, v); err != nil {
-			log.Println("KV add:", err)
+	for key, idx := range missing {
+		v := fetched[key]
+		for _, i := range idx {
+			res[i] = v
+		}
+		if !nocache[key] {
+			m.cache.Add(key, v)
 		}
 	}
 
-	return v, err
+	return res, hit, nil
 }
 
-func (m *DynamoKV) Set(key string, value []byte) error {
-	if err := m.cache.Add(key, locker); err != nil {
-		return err
+// Scan walks the table in DynamoDB's own order, 'cursor' is the last key of the previous page.
+// This is a full table scan which costs read capacity, it is only meant for admin tools.
+func (m *DynamoKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	res := []Pair{}
+	in := &dynamodb.ScanInput{
+		TableName: &m.table,
 	}
+	if limit > 0 {
+		in.Limit = aws.Int64(int64(limit))
+	}
+	if prefix != "" {
+		in.FilterExpression = aws.String("begins_with(id, :prefix)")
+		in.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":prefix": &dynamodb.AttributeValue{
+				S: aws.String(prefix),
+			},
+		}
+	}
+	if cursor != "" {
+		in.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: aws.String(cursor),
+			},
+		}
+	}
+
+	for {
+		out, err := m.db.Scan(in)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, item := range out.Items {
+			id, v := item["id"], dyValue(item)
+			if id == nil || id.S == nil || v == nil {
+				continue
+			}
+			res = append(res, Pair{*id.S, v})
+		}
+
+		if out.LastEvaluatedKey == nil {
+			if limit > 0 && len(res) > limit {
+				res = res[:limit]
+				return res, res[limit-1].Key, nil
+			}
+			return res, "", nil
+		}
+
+		if limit > 0 && len(res) >= limit {
+			res = res[:limit]
+			return res, res[limit-1].Key, nil
+		}
+		in.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (m *DynamoKV) Set(key string, value []byte) error {
+	m.cache.Lock(key)
 
 	in := &dynamodb.UpdateItemInput{
-		TableName: &dyTable,
+		TableName: &m.table,
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": &dynamodb.AttributeValue{
 				S: &key,
 			},
 		},
-		UpdateExpression: aws.String("set #xyzvalue = :value"),
+		UpdateExpression: aws.String("set #xyzvalue = :value add #ver :one"),
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":value": &dynamodb.AttributeValue{
-				S: aws.String(string(value)),
+			":value": dyAttr(value),
+			":one": &dynamodb.AttributeValue{
+				N: aws.String("1"),
 			},
 		},
 		ExpressionAttributeNames: map[string]*string{
 			"#xyzvalue": aws.String("value"),
+			"#ver":      aws.String("ver"),
 		},
 	}
 
@@ -119,17 +394,132 @@ func (m *DynamoKV) Set(key string, value []byte) error {
 	return err
 }
 
-// func (m *DynamoKV) Delete(key string) error {
-// 	m.cache.Remove(key)
-//
-// 	in := &dynamodb.DeleteItemInput{
-// 		TableName: &dyTable,
-// 		Key: map[string]*dynamodb.AttributeValue{
-// 			"id": &dynamodb.AttributeValue{
-// 				S: &key,
-// 			},
-// 		},
-// 	}
-// 	_, err := m.db.DeleteItem(in)
-// 	return err
-// }
+// GetWithVersion reads the value and its version with a consistent read, cache is bypassed.
+// Items written before versioning was introduced have version 0.
+func (m *DynamoKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	in := &dynamodb.GetItemInput{
+		TableName:      &m.table,
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: &key,
+			},
+		},
+	}
+
+	out, err := m.db.GetItem(in)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var v []byte
+	var ver uint64
+	v = dyValue(out.Item)
+	if vi := out.Item["ver"]; vi != nil && vi.N != nil {
+		ver, _ = strconv.ParseUint(*vi.N, 10, 64)
+	}
+	return v, ver, nil
+}
+
+// CompareAndSet writes the value only if the stored version equals 'ver', otherwise ErrConflict is returned
+func (m *DynamoKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	m.cache.Lock(key)
+
+	in := &dynamodb.UpdateItemInput{
+		TableName: &m.table,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: &key,
+			},
+		},
+		UpdateExpression: aws.String("set #xyzvalue = :value, #ver = :newver"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":value": dyAttr(value),
+			":newver": &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatUint(ver+1, 10)),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#xyzvalue": aws.String("value"),
+			"#ver":      aws.String("ver"),
+		},
+	}
+
+	if ver == 0 {
+		in.ConditionExpression = aws.String("attribute_not_exists(#ver)")
+	} else {
+		in.ConditionExpression = aws.String("#ver = :ver")
+		in.ExpressionAttributeValues[":ver"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatUint(ver, 10)),
+		}
+	}
+
+	_, err := m.db.UpdateItem(in)
+	if err == nil {
+		m.cache.Put(key, &cache.Entry{Value: value, Version: ver + 1})
+		return nil
+	}
+
+	// Our lock may have overwritten the value cached by the winner
+	m.cache.Remove(key)
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrConflict
+	}
+	return err
+}
+
+func (m *DynamoKV) Delete(key string) error {
+	m.cache.Lock(key)
+
+	in := &dynamodb.DeleteItemInput{
+		TableName: &m.table,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: &key,
+			},
+		},
+	}
+
+	_, err := m.db.DeleteItem(in)
+	if err == nil {
+		m.cache.Add(key, nil)
+	}
+	return err
+}
+
+// CompareAndDelete deletes the item only if the stored version equals 'ver', otherwise ErrConflict is returned
+func (m *DynamoKV) CompareAndDelete(key string, ver uint64) error {
+	m.cache.Lock(key)
+
+	in := &dynamodb.DeleteItemInput{
+		TableName: &m.table,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{
+				S: &key,
+			},
+		},
+		ConditionExpression: aws.String("#ver = :ver"),
+		ExpressionAttributeNames: map[string]*string{
+			"#ver": aws.String("ver"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":ver": &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatUint(ver, 10)),
+			},
+		},
+	}
+
+	_, err := m.db.DeleteItem(in)
+	if err == nil {
+		m.cache.Add(key, nil)
+		return nil
+	}
+
+	m.cache.Remove(key)
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrConflict
+	}
+	return err
+}
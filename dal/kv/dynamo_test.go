@@ -0,0 +1,90 @@
+package kv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+// fakeDynamo answers DynamoDB JSON requests, 'reply' gets the operation name and the request body
+func fakeDynamo(t *testing.T, reply func(op string, body map[string]interface{}) (int, string)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+		p, _ := ioutil.ReadAll(r.Body)
+		body := map[string]interface{}{}
+		json.Unmarshal(p, &body)
+		code, resp := reply(op, body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(code)
+		w.Write([]byte(resp))
+	}))
+}
+
+func dyError(code string) string {
+	return `{"__type":"com.amazonaws.dynamodb.v20120810#` + code + `","message":"test"}`
+}
+
+func TestDynamoKV(t *testing.T) {
+	var mu sync.Mutex
+	var created bool
+	var throttled int
+
+	srv := fakeDynamo(t, func(op string, body map[string]interface{}) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch op {
+		case "DescribeTable":
+			if !created {
+				return 400, dyError("ResourceNotFoundException")
+			}
+			return 200, `{"Table":{"TableName":"test","TableStatus":"ACTIVE"}}`
+		case "CreateTable":
+			created = true
+			return 200, `{"TableDescription":{"TableName":"test","TableStatus":"CREATING"}}`
+		case "GetItem":
+			if throttled++; throttled <= 2 {
+				return 400, dyError("ProvisionedThroughputExceededException")
+			}
+			return 200, `{"Item":{"id":{"S":"a"},"value":{"S":"1"},"ver":{"N":"3"}}}`
+		}
+		t.Error("unexpected", op, body)
+		return 500, ""
+	})
+	defer srv.Close()
+
+	c := DynamoConfig{Region: "local", AccessKey: "x", SecretKey: "x", Table: "test", Endpoint: srv.URL, RetryBase: time.Millisecond, RetryMax: time.Millisecond}
+	if _, err := NewDynamoKV(c); err == nil || !strings.Contains(err.Error(), "ResourceNotFound") {
+		t.Fatal("table doesn't exist")
+	}
+
+	c.CreateTable = true
+	db, err := NewDynamoKV(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetGlobalCache(cache.NewGlobalCache(10, nil))
+
+	v, ver, err := db.GetWithVersion("a")
+	if err != nil || string(v) != "1" || ver != 3 {
+		t.Fatal(string(v), ver, err)
+	}
+	if throttled != 3 {
+		t.Fatal(throttled)
+	}
+}
+
+func TestDynamoBackoff(t *testing.T) {
+	r := dyRetryer{retries: 5, base: 50 * time.Millisecond, max: 2 * time.Second}
+	for i := 0; i < 100; i++ {
+		if d := r.backoff(i % 40); d < 0 || d > r.max {
+			t.Fatal(i, d)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package kv
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+var (
+	errFaultInjected = fmt.Errorf("fault: injected error")
+	errFaultPartial  = fmt.Errorf("fault: write applied but the cache update was dropped")
+)
+
+const faultMaxStale = 4096
+
+// FaultConfig describes faults injected by FaultKV, all rates are in [0, 1]
+type FaultConfig struct {
+	ErrorRate   float64 // calls fail before reaching the backend
+	PartialRate float64 // writes are applied but the cache is not updated (the key stays locked) and an error is returned
+	StaleRate   float64 // reads return the value before the last write
+	LatencyMin  time.Duration
+	LatencyMax  time.Duration
+}
+
+// ParseFaultConfig parses strings like "error=0.01,partial=0.01,stale=0.05,latency=50ms-100ms"
+func ParseFaultConfig(s string) (FaultConfig, error) {
+	c := FaultConfig{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			return c, fmt.Errorf("invalid fault option: %q", kv)
+		}
+
+		var err error
+		switch p[0] {
+		case "error":
+			c.ErrorRate, err = strconv.ParseFloat(p[1], 64)
+		case "partial":
+			c.PartialRate, err = strconv.ParseFloat(p[1], 64)
+		case "stale":
+			c.StaleRate, err = strconv.ParseFloat(p[1], 64)
+		case "latency":
+			lat := strings.SplitN(p[1], "-", 2)
+			if c.LatencyMin, err = time.ParseDuration(lat[0]); err == nil {
+				c.LatencyMax = c.LatencyMin
+				if len(lat) == 2 {
+					c.LatencyMax, err = time.ParseDuration(lat[1])
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+
+		if err != nil {
+			return c, fmt.Errorf("invalid fault option %q: %v", kv, err)
+		}
+	}
+	return c, nil
+}
+
+// FaultKV wraps a backend and injects errors, latencies, partial failures and stale reads.
+// Partial failures happen in the GlobalCache given to SetGlobalCache, backends without a cache never see them.
+type FaultKV struct {
+	KeyValueOp
+	cfg FaultConfig
+
+	mu      sync.Mutex
+	stale   map[string][]byte // values before the last write
+	partial map[string]bool   // keys whose next cache update will be dropped, true once dropped
+}
+
+func NewFaultKV(db KeyValueOp, cfg FaultConfig) *FaultKV {
+	return &FaultKV{
+		KeyValueOp: db,
+		cfg:        cfg,
+		stale:      map[string][]byte{},
+		partial:    map[string]bool{},
+	}
+}
+
+func (m *FaultKV) SetGlobalCache(c *cache.GlobalCache) {
+	if m.cfg.PartialRate > 0 {
+		c.SetFault(m.dropCache)
+	}
+	m.KeyValueOp.SetGlobalCache(c)
+}
+
+// dropCache is called by the cache for every update, it drops the first one after a partial write has begun
+func (m *FaultKV) dropCache(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if dropped, ok := m.partial[key]; ok && !dropped {
+		m.partial[key] = true
+		return true
+	}
+	return false
+}
+
+func (m *FaultKV) hit(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// before sleeps for the configured latency, then decides whether the call should fail
+func (m *FaultKV) before() error {
+	if d := m.cfg.LatencyMax - m.cfg.LatencyMin; d > 0 {
+		time.Sleep(m.cfg.LatencyMin + time.Duration(rand.Int63n(int64(d))))
+	} else if m.cfg.LatencyMin > 0 {
+		time.Sleep(m.cfg.LatencyMin)
+	}
+	if m.hit(m.cfg.ErrorRate) {
+		return errFaultInjected
+	}
+	return nil
+}
+
+func (m *FaultKV) getStale(key string) ([]byte, bool) {
+	if !m.hit(m.cfg.StaleRate) {
+		return nil, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.stale[key]
+	return v, ok
+}
+
+// remember records the current value of the key, so it can be served as a stale read later
+func (m *FaultKV) remember(key string) {
+	if m.cfg.StaleRate <= 0 {
+		return
+	}
+	v, err := m.KeyValueOp.Get(key)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.stale) >= faultMaxStale {
+		for k := range m.stale {
+			delete(m.stale, k)
+			break
+		}
+	}
+	m.stale[key] = v
+}
+
+// begin decides whether the write is partial, the cache update following it will be dropped
+func (m *FaultKV) begin(key string) bool {
+	if !m.hit(m.cfg.PartialRate) {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.partial[key] = false
+	return true
+}
+
+func (m *FaultKV) after(key string, partial bool, err error) error {
+	if !partial {
+		return err
+	}
+	m.mu.Lock()
+	dropped := m.partial[key]
+	delete(m.partial, key)
+	m.mu.Unlock()
+
+	if err == nil && dropped {
+		return errFaultPartial
+	}
+	return err
+}
+
+func (m *FaultKV) Get(key string) ([]byte, error) {
+	if err := m.before(); err != nil {
+		return nil, err
+	}
+	if v, ok := m.getStale(key); ok {
+		return v, nil
+	}
+	return m.KeyValueOp.Get(key)
+}
+
+func (m *FaultKV) MultiGet(keys []string) ([][]byte, error) {
+	if err := m.before(); err != nil {
+		return nil, err
+	}
+	res, err := m.KeyValueOp.MultiGet(keys)
+	if err == nil {
+		for i, key := range keys {
+			if v, ok := m.getStale(key); ok {
+				res[i] = v
+			}
+		}
+	}
+	return res, err
+}
+
+func (m *FaultKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	if err := m.before(); err != nil {
+		return nil, 0, err
+	}
+	return m.KeyValueOp.GetWithVersion(key)
+}
+
+func (m *FaultKV) Set(key string, value []byte) error {
+	if err := m.before(); err != nil {
+		return err
+	}
+	m.remember(key)
+	partial := m.begin(key)
+	return m.after(key, partial, m.KeyValueOp.Set(key, value))
+}
+
+func (m *FaultKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	if err := m.before(); err != nil {
+		return err
+	}
+	m.remember(key)
+	partial := m.begin(key)
+	return m.after(key, partial, m.KeyValueOp.CompareAndSet(key, value, ver))
+}
+
+func (m *FaultKV) Delete(key string) error {
+	if err := m.before(); err != nil {
+		return err
+	}
+	m.remember(key)
+	partial := m.begin(key)
+	return m.after(key, partial, m.KeyValueOp.Delete(key))
+}
+
+func (m *FaultKV) CompareAndDelete(key string, ver uint64) error {
+	if err := m.before(); err != nil {
+		return err
+	}
+	m.remember(key)
+	partial := m.begin(key)
+	return m.after(key, partial, m.KeyValueOp.CompareAndDelete(key, ver))
+}
+
+func (m *FaultKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	if err := m.before(); err != nil {
+		return nil, "", err
+	}
+	return m.KeyValueOp.Scan(prefix, cursor, limit)
+}
@@ -0,0 +1,85 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+func TestFaultKV(t *testing.T) {
+	cfg, err := ParseFaultConfig("error=0.5, partial=1,stale=0,latency=1ms-2ms")
+	if err != nil || cfg.ErrorRate != 0.5 || cfg.PartialRate != 1 || cfg.LatencyMax != 2*time.Millisecond {
+		t.Fatal(cfg, err)
+	}
+	if _, err := ParseFaultConfig("error"); err == nil {
+		t.Fatal("should fail")
+	}
+
+	db, _ := NewMemoryKV("")
+	m := NewFaultKV(db, FaultConfig{StaleRate: 1})
+	m.Set("a", []byte("1"))
+	m.Set("a", []byte("2"))
+	if v, _ := db.Get("a"); string(v) != "2" {
+		t.Fatal(string(v))
+	}
+	if v, _ := m.Get("a"); string(v) != "1" {
+		t.Fatal(string(v))
+	}
+
+	m = NewFaultKV(db, FaultConfig{ErrorRate: 1})
+	if _, err := m.Get("a"); err != errFaultInjected {
+		t.Fatal(err)
+	}
+}
+
+func TestFaultKVPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := cache.NewGlobalCache(100, nil)
+	db := NewDiskKV(dir)
+	m := NewFaultKV(db, FaultConfig{PartialRate: 1})
+	m.SetGlobalCache(c)
+
+	m.cfg.PartialRate = 0
+	if err := m.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := c.Get("a"); e == nil || string(e.Value) != "1" {
+		t.Fatal(e)
+	}
+
+	m.cfg.PartialRate = 1
+	if err := m.Set("a", []byte("2")); err != errFaultPartial {
+		t.Fatal(err)
+	}
+
+	// The write went through, but the key stays locked in the cache until LockTTL
+	e, _ := c.Get("a")
+	if e == nil || e.State != cache.EntryWriting || e.TTL(time.Now()) < cache.LockTTL-time.Second {
+		t.Fatal(e)
+	}
+	if v, _ := m.Get("a"); string(v) != "2" {
+		t.Fatal(string(v))
+	}
+	if e, _ := c.Get("a"); e.State != cache.EntryWriting {
+		t.Fatal(e)
+	}
+	if len(m.partial) != 0 {
+		t.Fatal(m.partial)
+	}
+
+	// Without a cache, there is nothing to drop
+	mem, _ := NewMemoryKV("")
+	m = NewFaultKV(mem, FaultConfig{PartialRate: 1})
+	m.SetGlobalCache(cache.NewGlobalCache(100, nil))
+	if err := m.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,51 @@
+package kv
+
+import (
+	"sync"
+
+	"github.com/coyove/iis/common/metrics"
+)
+
+var kvCoalesced = metrics.NewCounter("iis_kv_coalesced_total", "Backend reads saved by joining an in-flight read of the same key", "backend")
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	v   []byte
+	err error
+}
+
+// flightGroup coalesces concurrent reads of the same key into one backend call,
+// callers share the returned slice so it must not be modified
+type flightGroup struct {
+	name string
+	mu   sync.Mutex
+	m    map[string]*flightCall
+}
+
+func (g *flightGroup) Do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = map[string]*flightCall{}
+	}
+	if c, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		kvCoalesced.Inc(g.name)
+		c.wg.Wait()
+		return c.v, c.err
+	}
+
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+
+	c.v, c.err = fn()
+	return c.v, c.err
+}
@@ -0,0 +1,34 @@
+package kv
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup(t *testing.T) {
+	g := flightGroup{name: "test"}
+	calls := int32(0)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := g.Do("a", func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(100 * time.Millisecond)
+				return []byte("1"), nil
+			})
+			if err != nil || string(v) != "1" {
+				t.Error(string(v), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatal("calls:", calls)
+	}
+}
@@ -1,14 +1,12 @@
 package kv
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"math/rand"
 	"net/url"
 	"os"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/coyove/iis/common"
 	"github.com/coyove/iis/dal/kv/cache"
@@ -17,95 +15,224 @@ import (
 
 type DiskKV struct {
 	cache *cache.GlobalCache
+	dir   string
+
+	// Versions are kept in memory, DiskKV is meant to be used by one process only
+	locks    [256]sync.Mutex
+	verMu    sync.Mutex
+	versions map[string]uint64
+	flight   flightGroup
 }
 
-func NewDiskKV() *DiskKV {
-	err := os.MkdirAll("tmp/data/", 0777)
+// NewDiskKV stores files under 'dir', default: tmp/data
+func NewDiskKV(dir string) *DiskKV {
+	if dir == "" {
+		dir = "tmp/data"
+	}
+	err := os.MkdirAll(dir, 0777)
 	if err != nil {
 		panic(err)
 	}
 
-	r := &DiskKV{}
+	r := &DiskKV{
+		dir:      dir,
+		versions: map[string]uint64{},
+		flight:   flightGroup{name: "disk"},
+	}
 	return r
 }
 
-func calcPath(key string) (string, string) {
-	dir := fmt.Sprintf("tmp/data/%d", common.Hash32(key)&0xff)
+func (m *DiskKV) calcPath(key string) (string, string) {
+	dir := fmt.Sprintf("%s/%d", m.dir, common.Hash32(key)&0xff)
 	return dir, dir + "/" + url.PathEscape(key) + ".txt"
 }
 
+// Scan lists all files under the directory, it is slow and only meant for admin tools
+func (m *DiskKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	keys := []string{}
+	for i := 0; i < 256; i++ {
+		dir, err := os.Open(fmt.Sprintf("%s/%d", m.dir, i))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, n := range names {
+			if !strings.HasSuffix(n, ".txt") {
+				continue
+			}
+			if k, err := url.PathUnescape(strings.TrimSuffix(n, ".txt")); err == nil {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	page, next := scanKeys(keys, prefix, cursor, limit)
+	res := make([]Pair, 0, len(page))
+	for _, k := range page {
+		_, fn := m.calcPath(k)
+		v, err := ioutil.ReadFile(fn)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+		res = append(res, Pair{k, v})
+	}
+	return res, next, nil
+}
+
 func (m *DiskKV) SetGlobalCache(c *cache.GlobalCache) {
 	m.cache = c
 }
 
 func (m *DiskKV) Get(key string) ([]byte, error) {
-	nocache := false
+	v, _, err := m.getCached(key)
+	return v, err
+}
 
-	v, ok := m.cache.Get(key)
-	if bytes.Equal(v, locker) {
-		v = nil
-		nocache = true
+func (m *DiskKV) getCached(key string) ([]byte, bool, error) {
+	e, ok := m.cache.Get(key)
+	if ok && e.State == cache.EntryWriting {
+		v, err := m.get(key)
+		return v, false, err
 	} else if ok {
-		return v, nil
+		return e.Value, true, nil
 	}
 
-	if randomError > 0 && rand.Intn(randomError) == 0 {
-		return nil, fmt.Errorf("1")
-	}
-
-	time.Sleep(time.Millisecond * time.Duration(rand.Intn(50)+50))
-
-	_, fn := calcPath(key)
-	_, err := os.Stat(fn)
+	v, err := m.flight.Do(key, func() ([]byte, error) {
+		v, err := m.get(key)
+		if err == nil {
+			m.cache.Add(key, v)
+		}
+		return v, err
+	})
+	return v, false, err
+}
 
-	if err == nil {
-		v, err = ioutil.ReadFile(fn)
-	} else if os.IsNotExist(err) {
-		err = nil
-	} else {
+func (m *DiskKV) get(key string) ([]byte, error) {
+	_, fn := m.calcPath(key)
+	v, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
 	}
+	return v, err
+}
 
-	if err == nil {
-		if !nocache {
-			m.cache.Add(key, v)
+func (m *DiskKV) MultiGet(keys []string) ([][]byte, error) {
+	res, _, err := m.multiGetCached(keys)
+	return res, err
+}
+
+func (m *DiskKV) multiGetCached(keys []string) ([][]byte, bool, error) {
+	res, all := make([][]byte, len(keys)), true
+	for i, key := range keys {
+		v, hit, err := m.getCached(key)
+		if err != nil {
+			return nil, false, err
 		}
+		res[i], all = v, all && hit
 	}
-
-	return v, err
+	return res, all, nil
 }
 
 func (m *DiskKV) Set(key string, value []byte) error {
-	if err := m.cache.Add(key, locker); err != nil {
-		return err
+	mu := &m.locks[common.Hash32(key)&0xff]
+	mu.Lock()
+	defer mu.Unlock()
+	return m.set(key, value)
+}
+
+func (m *DiskKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	mu := &m.locks[common.Hash32(key)&0xff]
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, fn := m.calcPath(key)
+	v, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		v, err = nil, nil
+	}
+	if err != nil {
+		return nil, 0, err
 	}
+	return v, m.version(key, 0), nil
+}
 
-	if randomError > 0 && rand.Intn(randomError) == 0 {
-		return fmt.Errorf("1")
+func (m *DiskKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	mu := &m.locks[common.Hash32(key)&0xff]
+	mu.Lock()
+	defer mu.Unlock()
+
+	if m.version(key, 0) != ver {
+		return ErrConflict
 	}
+	return m.set(key, value)
+}
+
+// version returns the current version of the key and adds 'inc' to it
+func (m *DiskKV) version(key string, inc uint64) uint64 {
+	m.verMu.Lock()
+	defer m.verMu.Unlock()
+	v := m.versions[key]
+	if inc > 0 {
+		m.versions[key] = v + inc
+	}
+	return v
+}
 
-	dir, fn := calcPath(key)
+func (m *DiskKV) set(key string, value []byte) error {
+	m.cache.Lock(key)
+
+	dir, fn := m.calcPath(key)
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return err
 	}
 
 	err := ioutil.WriteFile(fn, value, 0777)
 	if err == nil {
-		if err := m.cache.Add(key, value); err != nil {
-			log.Println("KV add:", err)
-		}
+		ver := m.version(key, 1) + 1
+		m.cache.Put(key, &cache.Entry{Value: value, Version: ver})
 	}
 	return err
 }
 
 func (m *DiskKV) Delete(key string) error {
-	panic(key)
-	// m.cache.Remove(key)
-
-	// return m.db.Update(func(tx *bbolt.Tx) error {
-	// 	bk, err := tx.CreateBucketIfNotExists(bkPost)
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	return bk.Delete([]byte(key))
-	// })
+	mu := &m.locks[common.Hash32(key)&0xff]
+	mu.Lock()
+	defer mu.Unlock()
+	return m.delete(key)
+}
+
+func (m *DiskKV) CompareAndDelete(key string, ver uint64) error {
+	mu := &m.locks[common.Hash32(key)&0xff]
+	mu.Lock()
+	defer mu.Unlock()
+
+	if m.version(key, 0) != ver {
+		return ErrConflict
+	}
+	return m.delete(key)
+}
+
+func (m *DiskKV) delete(key string) error {
+	m.cache.Lock(key)
+
+	_, fn := m.calcPath(key)
+	err := os.Remove(fn)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil {
+		m.verMu.Lock()
+		delete(m.versions, key)
+		m.verMu.Unlock()
+		m.cache.Add(key, nil)
+	}
+	return err
 }
@@ -0,0 +1,577 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coyove/iis/common"
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+// Record layout (little endian):
+//
+//	crc32 | flags (1) | version (8) | keylen (4) | vallen (4) | key | value
+//
+// crc32 covers everything after itself.
+const (
+	recHeaderSize = 4 + 1 + 8 + 4 + 4
+	recMaxKey     = 1 << 16
+	recMaxValue   = 1 << 30
+
+	compactMinSize = 64 << 20
+
+	recDelete = 1 << 0 // tombstone, value is empty
+)
+
+// logSeqKey is deleted at the start of every compacted log, its tombstone keeps the highest version
+// after the records which had it are gone
+const logSeqKey = "\x01seq"
+
+type logEntry struct {
+	off  int64 // offset of the record header
+	size int64 // total size of the record
+	ver  uint64
+}
+
+var ErrReadOnly = fmt.Errorf("LogKV: opened read-only")
+
+// LogKV is a single-file storage engine: every write is appended to the log,
+// an in-memory index maps keys to their latest records.
+// Only one process can open the log for writing, it holds an exclusive lock on "<path>.lock".
+type LogKV struct {
+	path     string
+	lock     *os.File
+	readOnly bool
+
+	mu      sync.RWMutex
+	f       *os.File
+	index   map[string]logEntry
+	end     int64  // end of the last complete record
+	garbage int64  // bytes occupied by overwritten records and tombstones
+	seq     uint64 // highest version in the log, every write takes the next one so versions are never reused
+
+	syncMu sync.Mutex
+	synced int64
+
+	compacting sync.Mutex
+}
+
+func NewLogKV(path string) (*LogKV, error) {
+	if path == "" {
+		path = "tmp/iis.db"
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+
+	lock, err := common.LockFile(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("LogKV: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	m := &LogKV{
+		path:  path,
+		lock:  lock,
+		f:     f,
+		index: map[string]logEntry{},
+	}
+
+	if err := m.recover(); err != nil {
+		f.Close()
+		lock.Close()
+		return nil, err
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			if m.needCompact() {
+				if err := m.Compact(); err != nil {
+					log.Println("[LogKV] compact:", err)
+				}
+			}
+		}
+	}()
+
+	return m, nil
+}
+
+// OpenLogKVReadOnly opens the log without taking the lock, so it can be read while the server is running.
+// It sees the records written before it is opened, a torn tail (may be a record being written) is ignored
+// instead of truncated, writes return ErrReadOnly and nothing is compacted.
+func OpenLogKVReadOnly(path string) (*LogKV, error) {
+	if path == "" {
+		path = "tmp/iis.db"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &LogKV{
+		path:     path,
+		readOnly: true,
+		f:        f,
+		index:    map[string]logEntry{},
+	}
+	if err := m.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// recover rebuilds the index by replaying the log. A torn tail (a bad record with no valid one after it)
+// is truncated, a bad record followed by valid ones is corruption and the log is not opened.
+func (m *LogKV) recover() error {
+	st := time.Now()
+	fi, err := m.f.Stat()
+	if err != nil {
+		return err
+	}
+	rd := bufio.NewReaderSize(io.NewSectionReader(m.f, 0, fi.Size()), 1<<20)
+
+	off, count := int64(0), 0
+	for {
+		key, _, flags, ver, size, err := readRecord(rd)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && m.validAfter(off, fi.Size()) {
+			return fmt.Errorf("LogKV: bad record at %d: %v, valid records follow it", off, err)
+		}
+		if err != nil && m.readOnly {
+			log.Println("[LogKV] recover: torn tail at", off, "error:", err, "ignored, opened read-only")
+			break
+		}
+		if err != nil {
+			log.Println("[LogKV] recover: torn tail at", off, "error:", err, "truncating")
+			if err := m.f.Truncate(off); err != nil {
+				return err
+			}
+			if err := m.f.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+
+		m.garbage += m.apply(m.index, key, flags, logEntry{off: off, size: size, ver: ver})
+		if ver > m.seq {
+			m.seq = ver
+		}
+		off += size
+		count++
+	}
+
+	m.end, m.synced = off, off
+	log.Println("[LogKV] recovered", count, "records,", len(m.index), "keys in", time.Since(st))
+	return nil
+}
+
+// validAfter reports whether a valid record starts anywhere in (off, size)
+func (m *LogKV) validAfter(off, size int64) bool {
+	const window = 1 << 20
+	buf := make([]byte, window+recHeaderSize)
+	for base := off + 1; base+recHeaderSize <= size; base += window {
+		n, _ := m.f.ReadAt(buf, base)
+		for i := 0; i < window && i+recHeaderSize <= n; i++ {
+			klen, vlen := binary.LittleEndian.Uint32(buf[i+13:]), binary.LittleEndian.Uint32(buf[i+17:])
+			pos := base + int64(i)
+			end := pos + recHeaderSize + int64(klen) + int64(vlen)
+			if klen == 0 || klen > recMaxKey || vlen > recMaxValue || end > size {
+				continue
+			}
+			if _, _, _, _, _, err := readRecord(io.NewSectionReader(m.f, pos, end-pos)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply updates the index with a new record and returns the number of bytes which became garbage
+func (m *LogKV) apply(index map[string]logEntry, key string, flags byte, e logEntry) (garbage int64) {
+	if old, ok := index[key]; ok {
+		garbage += old.size
+	}
+	if flags&recDelete != 0 {
+		delete(index, key)
+		return garbage + e.size
+	}
+	index[key] = e
+	return garbage
+}
+
+func readRecord(rd io.Reader) (key string, value []byte, flags byte, ver uint64, size int64, err error) {
+	hdr := [recHeaderSize]byte{}
+	if _, err = io.ReadFull(rd, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("short header")
+		}
+		return
+	}
+
+	klen, vlen := binary.LittleEndian.Uint32(hdr[13:]), binary.LittleEndian.Uint32(hdr[17:])
+	if klen > recMaxKey || vlen > recMaxValue {
+		err = fmt.Errorf("invalid record size: %d/%d", klen, vlen)
+		return
+	}
+
+	buf := make([]byte, int(klen)+int(vlen))
+	if _, err = io.ReadFull(rd, buf); err != nil {
+		err = fmt.Errorf("short record: %v", err)
+		return
+	}
+
+	h := crc32.NewIEEE()
+	h.Write(hdr[4:])
+	h.Write(buf)
+	if h.Sum32() != binary.LittleEndian.Uint32(hdr[:4]) {
+		err = fmt.Errorf("checksum mismatch")
+		return
+	}
+
+	flags = hdr[4]
+	ver = binary.LittleEndian.Uint64(hdr[5:])
+	key, value = string(buf[:klen]), buf[klen:]
+	size = int64(recHeaderSize + len(buf))
+	return
+}
+
+func appendRecord(buf []byte, key string, value []byte, flags byte, ver uint64) []byte {
+	hdr := [recHeaderSize]byte{}
+	hdr[4] = flags
+	binary.LittleEndian.PutUint64(hdr[5:], ver)
+	binary.LittleEndian.PutUint32(hdr[13:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(hdr[17:], uint32(len(value)))
+
+	h := crc32.NewIEEE()
+	h.Write(hdr[4:])
+	h.Write([]byte(key))
+	h.Write(value)
+	binary.LittleEndian.PutUint32(hdr[:4], h.Sum32())
+
+	buf = append(buf, hdr[:]...)
+	buf = append(buf, key...)
+	return append(buf, value...)
+}
+
+func (m *LogKV) SetGlobalCache(c *cache.GlobalCache) {
+	// Reads are served from the index and the OS page cache, there is nothing to gain from another cache layer
+}
+
+func (m *LogKV) Get(key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, ok := m.index[key]
+	if !ok {
+		return nil, nil
+	}
+
+	_, v, _, _, _, err := readRecord(io.NewSectionReader(m.f, e.off, e.size))
+	if err != nil {
+		return nil, fmt.Errorf("LogKV: read %q at %d: %v", key, e.off, err)
+	}
+	return v, nil
+}
+
+func (m *LogKV) MultiGet(keys []string) ([][]byte, error) {
+	res := make([][]byte, len(keys))
+	for i, key := range keys {
+		v, err := m.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = v
+	}
+	return res, nil
+}
+
+// Scan returns keys with the given prefix in lexical order, 'cursor' is the last key of the previous page
+func (m *LogKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.index))
+	for k := range m.index {
+		keys = append(keys, k)
+	}
+	m.mu.RUnlock()
+
+	page, next := scanKeys(keys, prefix, cursor, limit)
+	res := make([]Pair, 0, len(page))
+	for _, k := range page {
+		v, err := m.Get(k)
+		if err != nil {
+			return nil, "", err
+		}
+		if v != nil {
+			res = append(res, Pair{k, v})
+		}
+	}
+	return res, next, nil
+}
+
+func (m *LogKV) Set(key string, value []byte) error {
+	if len(key) == 0 || len(key) > recMaxKey || len(value) > recMaxValue {
+		return fmt.Errorf("LogKV: invalid key or value size")
+	}
+
+	end, err := m.append(key, value, 0, false, 0)
+	if err != nil {
+		return err
+	}
+	return m.sync(end)
+}
+
+func (m *LogKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, ok := m.index[key]
+	if !ok {
+		return nil, 0, nil
+	}
+
+	_, v, _, _, _, err := readRecord(io.NewSectionReader(m.f, e.off, e.size))
+	if err != nil {
+		return nil, 0, fmt.Errorf("LogKV: read %q at %d: %v", key, e.off, err)
+	}
+	return v, e.ver, nil
+}
+
+func (m *LogKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	if len(key) == 0 || len(key) > recMaxKey || len(value) > recMaxValue {
+		return fmt.Errorf("LogKV: invalid key or value size")
+	}
+
+	end, err := m.append(key, value, 0, true, ver)
+	if err != nil {
+		return err
+	}
+	return m.sync(end)
+}
+
+func (m *LogKV) Delete(key string) error {
+	m.mu.RLock()
+	_, ok := m.index[key]
+	m.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	end, err := m.append(key, nil, recDelete, false, 0)
+	if err != nil {
+		return err
+	}
+	return m.sync(end)
+}
+
+func (m *LogKV) CompareAndDelete(key string, ver uint64) error {
+	if ver == 0 {
+		return ErrConflict
+	}
+	end, err := m.append(key, nil, recDelete, true, ver)
+	if err != nil {
+		return err
+	}
+	return m.sync(end)
+}
+
+// append writes a record to the end of the log, if 'cas' is true, the current version must equal 'ver'
+func (m *LogKV) append(key string, value []byte, flags byte, cas bool, ver uint64) (int64, error) {
+	if m.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := m.index[key]
+	if cas && old.ver != ver {
+		return 0, ErrConflict
+	}
+	e := logEntry{off: m.end, ver: m.seq + 1}
+
+	buf := appendRecord(nil, key, value, flags, e.ver)
+	e.size = int64(len(buf))
+
+	if _, err := m.f.WriteAt(buf, m.end); err != nil {
+		// The partial record (if any) is beyond 'end' and will be overwritten by the next append
+		return 0, err
+	}
+
+	m.garbage += m.apply(m.index, key, flags, e)
+	m.end += e.size
+	m.seq = e.ver
+	return m.end, nil
+}
+
+// sync makes sure everything before 'end' is on disk, concurrent writers share one fsync
+func (m *LogKV) sync(end int64) error {
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+
+	if m.synced >= end {
+		return nil
+	}
+
+	m.mu.RLock()
+	f, target := m.f, m.end
+	m.mu.RUnlock()
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	m.synced = target
+	return nil
+}
+
+// syncDir makes a rename in the directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (m *LogKV) needCompact() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.end > compactMinSize && m.garbage > m.end/2
+}
+
+// Compact rewrites all live records into a new file and swaps it in.
+// Writes made during the copy are replayed onto the new file before the swap.
+func (m *LogKV) Compact() error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+
+	m.compacting.Lock()
+	defer m.compacting.Unlock()
+
+	st := time.Now()
+	m.mu.RLock()
+	snapshot := make(map[string]logEntry, len(m.index))
+	for k, e := range m.index {
+		snapshot[k] = e
+	}
+	snapEnd, seq := m.end, m.seq
+	m.mu.RUnlock()
+
+	tmp := m.path + ".compact"
+	nf, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	fail := func(err error) error {
+		nf.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	w := bufio.NewWriterSize(nf, 1<<20)
+	index := make(map[string]logEntry, len(snapshot))
+	off, garbage := int64(0), int64(0)
+
+	copyRecord := func(src io.ReaderAt, e logEntry) error {
+		buf := make([]byte, e.size)
+		if _, err := src.ReadAt(buf, e.off); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		e.off = off
+		off += e.size
+		k := string(buf[recHeaderSize : recHeaderSize+binary.LittleEndian.Uint32(buf[13:])])
+		garbage += m.apply(index, k, buf[4], e)
+		return nil
+	}
+
+	mark := appendRecord(nil, logSeqKey, nil, recDelete, seq)
+	if _, err := w.Write(mark); err != nil {
+		return fail(err)
+	}
+	off, garbage = int64(len(mark)), int64(len(mark))
+
+	for _, e := range snapshot {
+		if err := copyRecord(m.f, e); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Lock order must be the same as sync()
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Replay records appended after the snapshot, tombstones must be kept
+	// because the records they delete may have been copied already
+	rd := bufio.NewReader(io.NewSectionReader(m.f, snapEnd, m.end-snapEnd))
+	for pos := snapEnd; pos < m.end; {
+		_, _, _, ver, size, err := readRecord(rd)
+		if err != nil {
+			return fail(err)
+		}
+		if err := copyRecord(m.f, logEntry{off: pos, size: size, ver: ver}); err != nil {
+			return fail(err)
+		}
+		pos += size
+	}
+
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := nf.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fail(err)
+	}
+
+	old := m.f
+	m.f, m.index, m.end, m.garbage, m.synced = nf, index, off, garbage, off
+	old.Close()
+	// The new file is in use now, a failure only means the rename may be lost on an OS crash,
+	// which leaves the old log (still complete) in place
+	if err := syncDir(filepath.Dir(m.path)); err != nil {
+		log.Println("[LogKV] compact: sync dir:", err)
+	}
+	log.Println("[LogKV] compacted", snapEnd, "→", off, "bytes in", time.Since(st))
+	return nil
+}
+
+func (m *LogKV) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readOnly {
+		return m.f.Close()
+	}
+	if err := m.f.Sync(); err != nil {
+		return err
+	}
+	if err := m.f.Close(); err != nil {
+		return err
+	}
+	return m.lock.Close()
+}
@@ -0,0 +1,202 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func tempLogKV(t *testing.T) (*LogKV, string) {
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "iis.db")
+	m, err := NewLogKV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, path
+}
+
+func TestLogKV(t *testing.T) {
+	m, path := tempLogKV(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	for i := 0; i < 1000; i++ {
+		if err := m.Set(strconv.Itoa(i%100), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(m *LogKV) {
+		for i := 0; i < 100; i++ {
+			v, err := m.Get(strconv.Itoa(i))
+			if err != nil || string(v) != strconv.Itoa(i+900) {
+				t.Fatal(i, string(v), err)
+			}
+		}
+		if v, _ := m.Get("zzz"); v != nil {
+			t.Fatal(v)
+		}
+	}
+	check(m)
+
+	res, next, _ := m.Scan("1", "", 5)
+	if len(res) != 5 || next != "13" || res[0].Key != "1" || string(res[0].Value) != "901" {
+		t.Fatal(res, next)
+	}
+	res, next, _ = m.Scan("1", next, 100)
+	if len(res) != 6 || next != "" || res[0].Key != "14" {
+		t.Fatal(res, next)
+	}
+
+	if err := m.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(m)
+	m.Close()
+
+	// Simulate a torn write at the tail
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	f.Write(appendRecord(nil, "0", []byte("torn"), 0, 1)[:10])
+	f.Close()
+
+	m, err := NewLogKV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(m)
+
+	m.Set("a", []byte("b"))
+	if v, _ := m.Get("a"); string(v) != "b" {
+		t.Fatal(v)
+	}
+
+	_, ver, _ := m.GetWithVersion("a")
+	if err := m.CompareAndSet("a", []byte("c"), ver+1); err != ErrConflict {
+		t.Fatal(err)
+	}
+	if err := m.CompareAndSet("a", []byte("c"), ver); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CompareAndSet("new", []byte("c"), 0); err != nil {
+		t.Fatal(err)
+	}
+	_, ver, _ = m.GetWithVersion("new")
+	if err := m.CompareAndDelete("new", ver+1); err != ErrConflict {
+		t.Fatal(err)
+	}
+	if err := m.CompareAndDelete("new", ver); err != nil {
+		t.Fatal(err)
+	}
+
+	// Versions are not reused by a key created again
+	m.Set("new", []byte("d"))
+	if err := m.CompareAndSet("new", []byte("e"), ver); err != ErrConflict {
+		t.Fatal(err)
+	}
+	m.Delete("new")
+	if v, _ := m.Get("new"); v != nil {
+		t.Fatal(v)
+	}
+	m.Delete("a")
+	m.Compact()
+	m.Delete("0")
+	m.Close()
+
+	m, _ = NewLogKV(path)
+	if v, _ := m.Get("a"); v != nil {
+		t.Fatal(v)
+	}
+	if v, _ := m.Get("0"); v != nil {
+		t.Fatal(v)
+	}
+	m.Compact()
+	m.Close()
+
+	// The highest version survives compaction even if its key is gone
+	m, _ = NewLogKV(path)
+	m.Set("new", []byte("f"))
+	if _, v, _ := m.GetWithVersion("new"); v <= ver {
+		t.Fatal(v, ver)
+	}
+	m.Close()
+}
+
+func TestLogKVCorrupted(t *testing.T) {
+	m, path := tempLogKV(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	for i := 0; i < 10; i++ {
+		m.Set(strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+	end := m.end
+	m.Close()
+
+	// A flipped byte in the middle: nothing is truncated and the log is not opened
+	f, _ := os.OpenFile(path, os.O_RDWR, 0666)
+	f.WriteAt([]byte{'x'}, end/2)
+	f.Close()
+	if _, err := NewLogKV(path); err == nil {
+		t.Fatal("opened a corrupted log")
+	}
+	if _, err := OpenLogKVReadOnly(path); err == nil {
+		t.Fatal("opened a corrupted log")
+	}
+	if fi, _ := os.Stat(path); fi.Size() != end {
+		t.Fatal(fi.Size(), end)
+	}
+}
+
+func TestLogKVLock(t *testing.T) {
+	m, path := tempLogKV(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	m.Set("a", []byte("1"))
+
+	if _, err := NewLogKV(path); err == nil {
+		t.Fatal("opened a locked log")
+	}
+
+	// A torn tail may be a record being written by the owner, readers must leave it alone
+	m.f.WriteAt(appendRecord(nil, "b", []byte("torn"), 0, 1)[:10], m.end)
+	r, err := OpenLogKVReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.Get("a"); string(v) != "1" {
+		t.Fatal(v)
+	}
+	if err := r.Set("a", []byte("2")); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+	if err := r.Compact(); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+	r.Close()
+	if fi, _ := os.Stat(path); fi.Size() != m.end+10 {
+		t.Fatal(fi.Size(), m.end)
+	}
+
+	m.Close()
+	m, err = NewLogKV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+}
+
+func BenchmarkLogKVSet(b *testing.B) {
+	dir, _ := ioutil.TempDir("", "iis")
+	defer os.RemoveAll(dir)
+	m, _ := NewLogKV(filepath.Join(dir, "iis.db"))
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			m.Set(strconv.Itoa(i), []byte("value"))
+		}
+	})
+}
@@ -0,0 +1,220 @@
+package kv
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+type memEntry struct {
+	v   []byte
+	ver uint64
+}
+
+// MemoryKV keeps everything in a map, it is meant for tests and ephemeral instances.
+// If a snapshot path is given, data will be loaded from it on start and saved to it every minute and on Close.
+type MemoryKV struct {
+	mu       sync.RWMutex
+	m        map[string]memEntry
+	dirty    bool
+	snapshot string
+}
+
+func NewMemoryKV(snapshot string) (*MemoryKV, error) {
+	m := &MemoryKV{
+		m:        map[string]memEntry{},
+		snapshot: snapshot,
+	}
+
+	if snapshot == "" {
+		return m, nil
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			if err := m.Snapshot(); err != nil {
+				log.Println("[MemoryKV] snapshot:", err)
+			}
+		}
+	}()
+	return m, nil
+}
+
+func (m *MemoryKV) load() error {
+	f, err := os.Open(m.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	for {
+		key, value, _, ver, _, err := readRecord(rd)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		m.m[key] = memEntry{value, ver}
+	}
+
+	log.Println("[MemoryKV] loaded", len(m.m), "keys from", m.snapshot)
+	return nil
+}
+
+// Snapshot saves all data to the snapshot file if anything has changed since the last call
+func (m *MemoryKV) Snapshot() error {
+	if m.snapshot == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	m.dirty = false
+	data := make(map[string]memEntry, len(m.m))
+	for k, e := range m.m {
+		data[k] = e
+	}
+	m.mu.Unlock()
+
+	err := func() error {
+		if err := os.MkdirAll(filepath.Dir(m.snapshot), 0777); err != nil {
+			return err
+		}
+
+		tmp := m.snapshot + ".tmp"
+		f, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w := bufio.NewWriter(f)
+		buf := []byte{}
+		for k, e := range data {
+			buf = appendRecord(buf[:0], k, e.v, 0, e.ver)
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		return os.Rename(tmp, m.snapshot)
+	}()
+
+	if err != nil {
+		m.mu.Lock()
+		m.dirty = true
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// Close saves the snapshot, see dal.Close
+func (m *MemoryKV) Close() error {
+	return m.Snapshot()
+}
+
+func (m *MemoryKV) SetGlobalCache(c *cache.GlobalCache) {}
+
+func (m *MemoryKV) Get(key string) ([]byte, error) {
+	v, _, err := m.GetWithVersion(key)
+	return v, err
+}
+
+func (m *MemoryKV) MultiGet(keys []string) ([][]byte, error) {
+	res := make([][]byte, len(keys))
+	for i, key := range keys {
+		res[i], _ = m.Get(key)
+	}
+	return res, nil
+}
+
+func (m *MemoryKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.m[key]
+	if !ok {
+		return nil, 0, nil
+	}
+	return append([]byte{}, e.v...), e.ver, nil
+}
+
+func (m *MemoryKV) Set(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(key, value)
+	return nil
+}
+
+func (m *MemoryKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.m[key].ver != ver {
+		return ErrConflict
+	}
+	m.set(key, value)
+	return nil
+}
+
+func (m *MemoryKV) set(key string, value []byte) {
+	m.m[key] = memEntry{append([]byte{}, value...), m.m[key].ver + 1}
+	m.dirty = true
+}
+
+func (m *MemoryKV) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.m[key]; ok {
+		delete(m.m, key)
+		m.dirty = true
+	}
+	return nil
+}
+
+func (m *MemoryKV) CompareAndDelete(key string, ver uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.m[key]; !ok || e.ver != ver {
+		return ErrConflict
+	}
+	delete(m.m, key)
+	m.dirty = true
+	return nil
+}
+
+func (m *MemoryKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.m))
+	for k := range m.m {
+		keys = append(keys, k)
+	}
+
+	page, next := scanKeys(keys, prefix, cursor, limit)
+	res := make([]Pair, len(page))
+	for i, k := range page {
+		res[i] = Pair{k, append([]byte{}, m.m[k].v...)}
+	}
+	return res, next, nil
+}
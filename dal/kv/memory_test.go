@@ -0,0 +1,34 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryKVClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot")
+	m, err := NewMemoryKV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set("a", []byte("1"))
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = NewMemoryKV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("a"); string(v) != "1" {
+		t.Fatal(string(v))
+	}
+}
@@ -0,0 +1,118 @@
+package kv
+
+import (
+	"time"
+
+	"github.com/coyove/iis/common/metrics"
+)
+
+var (
+	kvDuration  = metrics.NewHistogram("iis_kv_op_duration_seconds", "Latency of KV operations by backend", metrics.DefBuckets, "backend", "op")
+	kvErrors    = metrics.NewCounter("iis_kv_errors_total", "Failed KV operations by backend, version conflicts excluded", "backend", "op")
+	kvConflicts = metrics.NewCounter("iis_kv_conflicts_total", "CompareAndSet version conflicts by backend", "backend")
+)
+
+// cachedReader is implemented by backends with a GlobalCache (disk, dynamo), 'hit' tells whether
+// the backend was skipped, for MultiGet whether all keys were cached
+type cachedReader interface {
+	getCached(key string) (v []byte, hit bool, err error)
+	multiGetCached(keys []string) (res [][]byte, hit bool, err error)
+}
+
+// MetricsKV records latencies and errors of the backend it wraps. Reads served by the backend's cache
+// are recorded as "get_cached" and "multiget_cached", so "get" and "multiget" are backend latencies.
+type MetricsKV struct {
+	KeyValueOp
+	backend string
+}
+
+func NewMetricsKV(db KeyValueOp, backend string) *MetricsKV {
+	return &MetricsKV{
+		KeyValueOp: db,
+		backend:    backend,
+	}
+}
+
+func (m *MetricsKV) observe(op string, start time.Time, err error) {
+	kvDuration.Since(start, m.backend, op)
+	switch err {
+	case nil:
+	case ErrConflict:
+		kvConflicts.Inc(m.backend)
+	default:
+		kvErrors.Inc(m.backend, op)
+	}
+}
+
+func cachedOp(op string, hit bool) string {
+	if hit {
+		return op + "_cached"
+	}
+	return op
+}
+
+func (m *MetricsKV) Get(key string) ([]byte, error) {
+	start := time.Now()
+	if c, ok := m.KeyValueOp.(cachedReader); ok {
+		v, hit, err := c.getCached(key)
+		m.observe(cachedOp("get", hit), start, err)
+		return v, err
+	}
+	v, err := m.KeyValueOp.Get(key)
+	m.observe("get", start, err)
+	return v, err
+}
+
+func (m *MetricsKV) MultiGet(keys []string) ([][]byte, error) {
+	start := time.Now()
+	if c, ok := m.KeyValueOp.(cachedReader); ok {
+		v, hit, err := c.multiGetCached(keys)
+		m.observe(cachedOp("multiget", hit), start, err)
+		return v, err
+	}
+	v, err := m.KeyValueOp.MultiGet(keys)
+	m.observe("multiget", start, err)
+	return v, err
+}
+
+func (m *MetricsKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	start := time.Now()
+	v, ver, err := m.KeyValueOp.GetWithVersion(key)
+	m.observe("get", start, err)
+	return v, ver, err
+}
+
+func (m *MetricsKV) Set(key string, value []byte) error {
+	start := time.Now()
+	err := m.KeyValueOp.Set(key, value)
+	m.observe("set", start, err)
+	return err
+}
+
+func (m *MetricsKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	start := time.Now()
+	err := m.KeyValueOp.CompareAndSet(key, value, ver)
+	m.observe("cas", start, err)
+	return err
+}
+
+func (m *MetricsKV) Delete(key string) error {
+	start := time.Now()
+	err := m.KeyValueOp.Delete(key)
+	m.observe("delete", start, err)
+	return err
+}
+
+func (m *MetricsKV) CompareAndDelete(key string, ver uint64) error {
+	start := time.Now()
+	err := m.KeyValueOp.CompareAndDelete(key, ver)
+	m.observe("cad", start, err)
+	return err
+}
+
+func (m *MetricsKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	start := time.Now()
+	res, next, err := m.KeyValueOp.Scan(prefix, cursor, limit)
+	m.observe("scan", start, err)
+	return res, next, err
+}
@@ -0,0 +1,40 @@
+package kv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coyove/iis/common/metrics"
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+func TestMetricsKVCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewMetricsKV(NewDiskKV(dir), "test_disk")
+	m.SetGlobalCache(cache.NewGlobalCache(100, nil))
+	m.Set("a", []byte("1"))
+	m.Get("a")
+	m.Get("a")
+	m.MultiGet([]string{"a", "b"})
+	m.MultiGet([]string{"a", "b"})
+
+	buf := &bytes.Buffer{}
+	metrics.Write(buf)
+	for _, line := range []string{
+		`iis_kv_op_duration_seconds_count{backend="test_disk",op="get_cached"} 2`,
+		`iis_kv_op_duration_seconds_count{backend="test_disk",op="multiget"} 1`,
+		`iis_kv_op_duration_seconds_count{backend="test_disk",op="multiget_cached"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatal("missing:", line)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package kv
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/coyove/iis/common"
+	"github.com/coyove/iis/common/metrics"
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+var (
+	mirrorErrors     = metrics.NewCounter("iis_mirror_errors_total", "Failed writes to the secondary backend of MirrorKV", "op")
+	mirrorMismatches = metrics.NewCounter("iis_mirror_mismatches_total", "Shadow reads which found different values in the secondary backend", "op")
+)
+
+const (
+	mirrorStripes = 256
+	mirrorShadows = 64 // max shadow reads in flight, more are dropped
+)
+
+// MirrorKV writes to both backends and reads from the primary only, which stays the source of truth:
+// failed writes to the secondary are logged and counted, not returned. Versions are the primary's,
+// the secondary always receives plain Sets of the values the primary has accepted.
+//
+// To migrate, set Mirror to the new backend and run Backfill, then swap Storage and Mirror
+// (the old backend is kept in sync for rolling back) and finally remove Mirror.
+type MirrorKV struct {
+	KeyValueOp
+	secondary  KeyValueOp
+	shadowRate float64 // [0, 1]
+
+	stripes [mirrorStripes]sync.Mutex // orders writes of the same key on the secondary
+	shadows chan struct{}
+}
+
+type BackfillReport struct {
+	Scanned    int
+	Copied     int // missing in the secondary
+	Fixed      int // different in the secondary, overwritten
+	Mismatched int // different in the secondary, left as is
+}
+
+func NewMirrorKV(primary, secondary KeyValueOp, shadowRate float64) *MirrorKV {
+	return &MirrorKV{
+		KeyValueOp: primary,
+		secondary:  secondary,
+		shadowRate: shadowRate,
+		shadows:    make(chan struct{}, mirrorShadows),
+	}
+}
+
+func (m *MirrorKV) lock(key string) *sync.Mutex {
+	mu := &m.stripes[common.Hash32(key)%mirrorStripes]
+	mu.Lock()
+	return mu
+}
+
+// SetGlobalCache gives the secondary a local cache of its own for its write path, sharing Redis would mix up
+// entries of both backends. The secondary is read by secondaryGet only, which bypasses caches, so the writes
+// of other processes are seen.
+func (m *MirrorKV) SetGlobalCache(c *cache.GlobalCache) {
+	m.KeyValueOp.SetGlobalCache(c)
+	m.secondary.SetGlobalCache(cache.NewGlobalCache(1000, nil))
+}
+
+func (m *MirrorKV) Get(key string) ([]byte, error) {
+	v, err := m.KeyValueOp.Get(key)
+	if err == nil {
+		m.shadow("get", []string{key}, [][]byte{v})
+	}
+	return v, err
+}
+
+func (m *MirrorKV) MultiGet(keys []string) ([][]byte, error) {
+	res, err := m.KeyValueOp.MultiGet(keys)
+	if err == nil {
+		m.shadow("multiget", keys, res)
+	}
+	return res, err
+}
+
+func (m *MirrorKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	v, ver, err := m.KeyValueOp.GetWithVersion(key)
+	if err == nil {
+		m.shadow("get", []string{key}, [][]byte{v})
+	}
+	return v, ver, err
+}
+
+// shadow compares values read from the primary with the secondary in the background
+func (m *MirrorKV) shadow(op string, keys []string, values [][]byte) {
+	if m.shadowRate <= 0 || rand.Float64() >= m.shadowRate {
+		return
+	}
+	select {
+	case m.shadows <- struct{}{}:
+	default:
+		return
+	}
+
+	go func() {
+		defer func() { <-m.shadows }()
+		for i, k := range keys {
+			sv, err := m.secondaryGet(k)
+			if err != nil {
+				log.Println("[MirrorKV] shadow read:", err)
+				return
+			}
+			if bytes.Equal(values[i], sv) {
+				continue
+			}
+			// Written after the read, not a mismatch
+			if v, err := m.KeyValueOp.Get(k); err != nil || !bytes.Equal(v, values[i]) {
+				continue
+			}
+			mirrorMismatches.Inc(op)
+			log.Printf("[MirrorKV] shadow read mismatch: %q, primary: %d bytes, secondary: %d bytes", k, len(values[i]), len(sv))
+		}
+	}()
+}
+
+// secondaryGet reads by GetWithVersion, which is uncached in every backend (it is the read before CompareAndSet)
+func (m *MirrorKV) secondaryGet(key string) ([]byte, error) {
+	v, _, err := m.secondary.GetWithVersion(key)
+	return v, err
+}
+
+func (m *MirrorKV) Set(key string, value []byte) error {
+	defer m.lock(key).Unlock()
+	if err := m.KeyValueOp.Set(key, value); err != nil {
+		return err
+	}
+	m.secondaryErr("set", key, m.secondary.Set(key, value))
+	return nil
+}
+
+func (m *MirrorKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	defer m.lock(key).Unlock()
+	if err := m.KeyValueOp.CompareAndSet(key, value, ver); err != nil {
+		return err
+	}
+	m.secondaryErr("set", key, m.secondary.Set(key, value))
+	return nil
+}
+
+func (m *MirrorKV) Delete(key string) error {
+	defer m.lock(key).Unlock()
+	if err := m.KeyValueOp.Delete(key); err != nil {
+		return err
+	}
+	m.secondaryErr("delete", key, m.secondary.Delete(key))
+	return nil
+}
+
+func (m *MirrorKV) CompareAndDelete(key string, ver uint64) error {
+	defer m.lock(key).Unlock()
+	if err := m.KeyValueOp.CompareAndDelete(key, ver); err != nil {
+		return err
+	}
+	m.secondaryErr("delete", key, m.secondary.Delete(key))
+	return nil
+}
+
+func (m *MirrorKV) secondaryErr(op, key string, err error) {
+	if err != nil {
+		mirrorErrors.Inc(op)
+		log.Println("[MirrorKV] secondary", op, key, err)
+	}
+}
+
+// Backfill copies keys missing in the secondary, differing values are overwritten only if 'overwrite' is true.
+// Each key is compared under the same lock as writes, so it must run in the process serving writes
+// (or while no one is writing), 'pause' is slept between pages to limit the load. With several server
+// processes, concurrent writes of other processes may still leave a key different, run it again offline.
+func (m *MirrorKV) Backfill(overwrite bool, pause time.Duration) (*BackfillReport, error) {
+	r := &BackfillReport{}
+	for cursor := ""; ; {
+		res, next, err := m.KeyValueOp.Scan("", cursor, 1000)
+		if err != nil {
+			return r, err
+		}
+		for _, p := range res {
+			r.Scanned++
+			if err := m.backfill(p.Key, overwrite, r); err != nil {
+				return r, err
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+		log.Println("[MirrorKV] backfill:", r.Scanned, "keys scanned")
+		time.Sleep(pause)
+	}
+	return r, nil
+}
+
+func (m *MirrorKV) backfill(key string, overwrite bool, r *BackfillReport) error {
+	defer m.lock(key).Unlock()
+
+	// Re-read under the lock, the scanned value may be outdated
+	v, err := m.KeyValueOp.Get(key)
+	if err != nil || v == nil {
+		return err
+	}
+	sv, err := m.secondaryGet(key)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case sv == nil:
+		r.Copied++
+	case bytes.Equal(v, sv):
+		return nil
+	case overwrite:
+		r.Fixed++
+	default:
+		r.Mismatched++
+		log.Printf("[MirrorKV] backfill mismatch: %q", key)
+		return nil
+	}
+	return m.secondary.Set(key, v)
+}
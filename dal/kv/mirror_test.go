@@ -0,0 +1,93 @@
+package kv
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coyove/iis/common/metrics"
+)
+
+func TestMirrorKV(t *testing.T) {
+	primary, _ := NewMemoryKV("")
+	secondary, _ := NewMemoryKV("")
+	for i := 0; i < 100; i++ {
+		primary.Set(strconv.Itoa(i), []byte("old"))
+	}
+
+	m := NewMirrorKV(primary, secondary, 0)
+	m.Set("1", []byte("1"))
+	if v, _ := secondary.Get("1"); string(v) != "1" {
+		t.Fatal(string(v))
+	}
+
+	_, ver, _ := m.GetWithVersion("2")
+	if err := m.CompareAndSet("2", []byte("2"), ver); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CompareAndSet("2", []byte("x"), ver); err != ErrConflict {
+		t.Fatal(err)
+	}
+	if v, _ := secondary.Get("2"); string(v) != "2" {
+		t.Fatal(string(v))
+	}
+
+	m.Delete("1")
+	if v, _ := secondary.Get("1"); v != nil {
+		t.Fatal(string(v))
+	}
+
+	secondary.Set("3", []byte("drift"))
+	m.shadowRate = 1
+	m.Get("3")
+	m.shadowRate = 0
+	for i := 0; ; i++ {
+		buf := &bytes.Buffer{}
+		metrics.Write(buf)
+		if strings.Contains(buf.String(), `iis_mirror_mismatches_total{op="get"} 1`) {
+			break
+		}
+		if i > 100 {
+			t.Fatal("mismatch not found")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r, err := m.Backfill(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Scanned != 99 || r.Copied != 97 || r.Mismatched != 1 {
+		t.Fatal(r)
+	}
+	if r, _ := m.Backfill(true, 0); r.Copied != 0 || r.Fixed != 1 {
+		t.Fatal(r)
+	}
+	if v, _ := secondary.Get("3"); string(v) != "old" {
+		t.Fatal(string(v))
+	}
+}
+
+// staleKV serves Get from a cache which other processes' writes don't invalidate
+type staleKV struct {
+	*MemoryKV
+}
+
+func (s staleKV) Get(key string) ([]byte, error) {
+	return []byte("stale"), nil
+}
+
+func TestMirrorKVUncached(t *testing.T) {
+	primary, _ := NewMemoryKV("")
+	secondary, _ := NewMemoryKV("")
+	primary.Set("a", []byte("1"))
+	secondary.Set("a", []byte("1"))
+
+	m := NewMirrorKV(primary, staleKV{secondary}, 0)
+	r, err := m.Backfill(false, 0)
+	if err != nil || r.Scanned != 1 || r.Copied != 0 || r.Mismatched != 0 {
+		t.Fatal(r, err)
+	}
+}
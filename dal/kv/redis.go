@@ -0,0 +1,249 @@
+package kv
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coyove/iis/dal/kv/cache"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Every key is stored as a hash: { v: value, ver: version }, and indexed in the sorted set redisIndexKey
+// (all scores are 0, so members are sorted by bytes) for Scan. KEYS[2] is the index, ARGV[3] the unprefixed key.
+var (
+	redisSetScript = redis.NewScript(2, `
+redis.call('HSET', KEYS[1], 'v', ARGV[1])
+redis.call('ZADD', KEYS[2], 0, ARGV[3])
+return redis.call('HINCRBY', KEYS[1], 'ver', 1)`)
+
+	redisCASScript = redis.NewScript(2, `
+local ver = tonumber(redis.call('HGET', KEYS[1], 'ver') or '0')
+if ver ~= tonumber(ARGV[2]) then return 0 end
+redis.call('HSET', KEYS[1], 'v', ARGV[1])
+redis.call('HSET', KEYS[1], 'ver', ver + 1)
+redis.call('ZADD', KEYS[2], 0, ARGV[3])
+return 1`)
+
+	redisDeleteScript = redis.NewScript(2, `
+redis.call('ZREM', KEYS[2], ARGV[1])
+return redis.call('DEL', KEYS[1])`)
+
+	redisCADScript = redis.NewScript(2, `
+local ver = tonumber(redis.call('HGET', KEYS[1], 'ver') or '0')
+if ver == 0 or ver ~= tonumber(ARGV[2]) then return 0 end
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('DEL', KEYS[1])
+return 1`)
+)
+
+const (
+	redisKeyPrefix = "iis:"
+	redisIndexKey  = "iis-keys"
+)
+
+// RedisKV uses Redis as the source of truth, keys are prefixed so the instance can be shared with GlobalCache
+type RedisKV struct {
+	c *redis.Pool
+}
+
+// NewRedisKV connects to "host:port[/db]", it fails if AOF is disabled (or can't be verified) unless 'volatile' is true
+func NewRedisKV(addr string, volatile bool) (*RedisKV, error) {
+	db := 0
+	if i := strings.LastIndex(addr, "/"); i >= 0 {
+		n, err := strconv.Atoi(addr[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis db: %q", addr)
+		}
+		addr, db = addr[:i], n
+	}
+
+	options := []redis.DialOption{
+		redis.DialDatabase(db),
+		redis.DialConnectTimeout(time.Second),
+		redis.DialReadTimeout(time.Second),
+		redis.DialWriteTimeout(time.Second),
+	}
+
+	m := &RedisKV{
+		c: &redis.Pool{
+			MaxIdle:     64,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr, options...)
+			},
+		},
+	}
+
+	c := m.c.Get()
+	defer c.Close()
+
+	if _, err := c.Do("PING"); err != nil {
+		return nil, err
+	}
+
+	if err := m.checkPersistence(c); err != nil {
+		if !volatile {
+			return nil, fmt.Errorf("%v, set RedisVolatile to use it anyway", err)
+		}
+		log.Println("[RedisKV] WARNING:", err)
+	}
+	return m, nil
+}
+
+// checkPersistence returns an error if the Redis instance would lose writes on crash
+func (m *RedisKV) checkPersistence(c redis.Conn) error {
+	aof, err1 := redis.Strings(c.Do("CONFIG", "GET", "appendonly"))
+	rdb, err2 := redis.Strings(c.Do("CONFIG", "GET", "save"))
+	if err1 != nil || err2 != nil {
+		return fmt.Errorf("redis: can't verify persistence settings: %v %v", err1, err2)
+	}
+	if len(aof) == 2 && aof[1] == "yes" {
+		return nil
+	}
+	if len(rdb) == 2 && strings.TrimSpace(rdb[1]) != "" {
+		return fmt.Errorf("redis: AOF is disabled, writes after the last RDB snapshot will be lost on crash")
+	}
+	return fmt.Errorf("redis: neither AOF nor RDB is enabled, all data will be lost on restart")
+}
+
+func (m *RedisKV) SetGlobalCache(c *cache.GlobalCache) {
+	// Redis is already the cache, no more layering
+}
+
+func (m *RedisKV) Get(key string) ([]byte, error) {
+	c := m.c.Get()
+	defer c.Close()
+
+	v, err := redis.Bytes(c.Do("HGET", redisKeyPrefix+key, "v"))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (m *RedisKV) MultiGet(keys []string) ([][]byte, error) {
+	c := m.c.Get()
+	defer c.Close()
+
+	for _, key := range keys {
+		if err := c.Send("HGET", redisKeyPrefix+key, "v"); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+
+	res := make([][]byte, len(keys))
+	for i := range keys {
+		v, err := redis.Bytes(c.Receive())
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		res[i] = v
+	}
+	return res, nil
+}
+
+func (m *RedisKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	c := m.c.Get()
+	defer c.Close()
+
+	res, err := redis.ByteSlices(c.Do("HMGET", redisKeyPrefix+key, "v", "ver"))
+	if err != nil {
+		return nil, 0, err
+	}
+	ver, _ := strconv.ParseUint(string(res[1]), 10, 64)
+	return res[0], ver, nil
+}
+
+func (m *RedisKV) Set(key string, value []byte) error {
+	c := m.c.Get()
+	defer c.Close()
+
+	_, err := redisSetScript.Do(c, redisKeyPrefix+key, redisIndexKey, value, 0, key)
+	return err
+}
+
+func (m *RedisKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	c := m.c.Get()
+	defer c.Close()
+
+	ok, err := redis.Int(redisCASScript.Do(c, redisKeyPrefix+key, redisIndexKey, value, ver, key))
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (m *RedisKV) Delete(key string) error {
+	c := m.c.Get()
+	defer c.Close()
+
+	_, err := redisDeleteScript.Do(c, redisKeyPrefix+key, redisIndexKey, key)
+	return err
+}
+
+func (m *RedisKV) CompareAndDelete(key string, ver uint64) error {
+	c := m.c.Get()
+	defer c.Close()
+
+	ok, err := redis.Int(redisCADScript.Do(c, redisKeyPrefix+key, redisIndexKey, key, ver))
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// Scan reads sorted keys from the index, 'cursor' is the last key of the previous page like other backends
+func (m *RedisKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+
+	min := "[" + prefix
+	if cursor != "" && cursor >= prefix {
+		min = "(" + cursor
+	}
+
+	c := m.c.Get()
+	keys, err := redis.Strings(c.Do("ZRANGEBYLEX", redisIndexKey, min, "+", "LIMIT", 0, limit+1))
+	c.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	for i, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			keys = keys[:i]
+			break
+		}
+	}
+	if len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+
+	values, err := m.MultiGet(keys)
+	if err != nil {
+		return nil, "", err
+	}
+
+	res := make([]Pair, 0, len(keys))
+	for i := range keys {
+		if values[i] != nil {
+			res = append(res, Pair{keys[i], values[i]})
+		}
+	}
+	return res, next, nil
+}
@@ -0,0 +1,74 @@
+package kv
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+)
+
+func TestRedisKV(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// miniredis has no CONFIG, persistence can't be verified
+	if _, err := NewRedisKV(s.Addr(), false); err == nil {
+		t.Fatal("persistence not checked")
+	}
+	m, err := NewRedisKV(s.Addr(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := m.Set(strconv.Itoa(i), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, _ := m.Get("7"); string(v) != "7" {
+		t.Fatal(v)
+	}
+
+	_, ver, _ := m.GetWithVersion("7")
+	if err := m.CompareAndSet("7", []byte("x"), ver+1); err != ErrConflict {
+		t.Fatal(err)
+	}
+	if err := m.CompareAndSet("7", []byte("x"), ver); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CompareAndSet("new", []byte("y"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := m.MultiGet([]string{"7", "zzz", "new"}); string(res[0]) != "x" || res[1] != nil || string(res[2]) != "y" {
+		t.Fatal(res)
+	}
+
+	if err := m.Delete("12"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("12"); v != nil {
+		t.Fatal(v)
+	}
+	if err := m.CompareAndDelete("new", 2); err != ErrConflict {
+		t.Fatal(err)
+	}
+	if err := m.CompareAndDelete("new", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// "1", "10", "11", "13" ... "19"
+	res, next, err := m.Scan("1", "", 5)
+	if err != nil || len(res) != 5 || next != "14" || res[0].Key != "1" || res[3].Key != "13" {
+		t.Fatal(res, next, err)
+	}
+	res, next, _ = m.Scan("1", next, 5)
+	if len(res) != 5 || next != "" || res[0].Key != "15" || res[4].Key != "19" {
+		t.Fatal(res, next)
+	}
+	if res, next, _ := m.Scan("", "", 100); len(res) != 19 || next != "" {
+		t.Fatal(len(res), next)
+	}
+}
@@ -0,0 +1,189 @@
+package kv
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/coyove/iis/common"
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+// ShardKV spreads keys over several backends by common.Draw. Shards are named "NN]name",
+// NN is the weight (00 ~ 99), the name must stay the same when the weight changes.
+// After adding a shard or changing weights, run Rebalance to move keys to their new shards.
+type ShardKV struct {
+	names  []string
+	shards []KeyValueOp
+	index  map[string]int
+	cache  *cache.GlobalCache
+}
+
+func NewShardKV(names []string, shards []KeyValueOp) (*ShardKV, error) {
+	if len(names) == 0 || len(names) != len(shards) {
+		return nil, fmt.Errorf("shard: expect names for %d shards, got %d", len(shards), len(names))
+	}
+	s := &ShardKV{
+		names:  names,
+		shards: shards,
+		index:  map[string]int{},
+	}
+	for i, n := range names {
+		if _, ok := s.index[n]; ok {
+			return nil, fmt.Errorf("shard: duplicated name %q", n)
+		}
+		s.index[n] = i
+	}
+	return s, nil
+}
+
+func (s *ShardKV) shardIndex(key string) int {
+	i, ok := s.index[common.Draw(key, s.names)]
+	if !ok {
+		// All weights are 0
+		return 0
+	}
+	return i
+}
+
+func (s *ShardKV) shard(key string) KeyValueOp {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *ShardKV) SetGlobalCache(c *cache.GlobalCache) {
+	s.cache = c
+	for _, db := range s.shards {
+		db.SetGlobalCache(c)
+	}
+}
+
+func (s *ShardKV) Get(key string) ([]byte, error) {
+	return s.shard(key).Get(key)
+}
+
+func (s *ShardKV) MultiGet(keys []string) ([][]byte, error) {
+	res := make([][]byte, len(keys))
+	groups := map[int][]int{}
+	for i, k := range keys {
+		si := s.shardIndex(k)
+		groups[si] = append(groups[si], i)
+	}
+
+	for si, idx := range groups {
+		ks := make([]string, len(idx))
+		for j, i := range idx {
+			ks[j] = keys[i]
+		}
+		vs, err := s.shards[si].MultiGet(ks)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range idx {
+			res[i] = vs[j]
+		}
+	}
+	return res, nil
+}
+
+func (s *ShardKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	return s.shard(key).GetWithVersion(key)
+}
+
+func (s *ShardKV) Set(key string, value []byte) error {
+	return s.shard(key).Set(key, value)
+}
+
+func (s *ShardKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	return s.shard(key).CompareAndSet(key, value, ver)
+}
+
+func (s *ShardKV) Delete(key string) error {
+	return s.shard(key).Delete(key)
+}
+
+func (s *ShardKV) CompareAndDelete(key string, ver uint64) error {
+	return s.shard(key).CompareAndDelete(key, ver)
+}
+
+// Scan walks shards one by one, keys are sorted within a shard only.
+// The cursor is "<shard index>:<cursor of the shard>".
+func (s *ShardKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	si, inner := 0, ""
+	if cursor != "" {
+		p := strings.SplitN(cursor, ":", 2)
+		i, err := strconv.Atoi(p[0])
+		if len(p) != 2 || err != nil || i < 0 || i >= len(s.shards) {
+			return nil, "", fmt.Errorf("shard: invalid cursor %q", cursor)
+		}
+		si, inner = i, p[1]
+	}
+
+	res, next, err := s.shards[si].Scan(prefix, inner, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	if next != "" {
+		return res, strconv.Itoa(si) + ":" + next, nil
+	}
+	if si+1 < len(s.shards) {
+		return res, strconv.Itoa(si+1) + ":", nil
+	}
+	return res, "", nil
+}
+
+type RebalanceReport struct {
+	Scanned int
+	Moved   map[string]int // "from -> to" -> number of keys
+}
+
+// Rebalance moves keys which are not on the shard Draw picks. A key is copied to its new shard
+// first, then deleted from the old one, so a crash in between leaves two copies, which the next run cleans up.
+// The copy is CompareAndSet with version 0: if the new shard already has the key (written after
+// the layout changed), it wins. Keys being moved can't be read, so it is meant to be run offline.
+func (s *ShardKV) Rebalance(dry bool) (*RebalanceReport, error) {
+	r := &RebalanceReport{Moved: map[string]int{}}
+	for from, db := range s.shards {
+		// Deleting during the scan is fine, scan cursors are keys
+		for cursor := ""; ; {
+			res, next, err := db.Scan("", cursor, 1000)
+			if err != nil {
+				return r, err
+			}
+			for _, p := range res {
+				r.Scanned++
+				to := s.shardIndex(p.Key)
+				if to == from {
+					continue
+				}
+				r.Moved[s.names[from]+" -> "+s.names[to]]++
+				if dry {
+					continue
+				}
+				if err := s.move(p, db, s.shards[to]); err != nil {
+					return r, err
+				}
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		log.Println("[ShardKV] rebalance:", s.names[from], "done,", r.Scanned, "keys scanned")
+	}
+	return r, nil
+}
+
+func (s *ShardKV) move(p Pair, from, to KeyValueOp) error {
+	if err := to.CompareAndSet(p.Key, p.Value, 0); err != nil && err != ErrConflict {
+		return err
+	}
+	if err := from.Delete(p.Key); err != nil {
+		return err
+	}
+	// Shards share the cache, the delete above has cached the key as missing
+	if s.cache != nil {
+		s.cache.Remove(p.Key)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package kv
+
+import (
+	"strconv"
+	"testing"
+)
+
+func newTestShards(t *testing.T, names ...string) (*ShardKV, []KeyValueOp) {
+	dbs := make([]KeyValueOp, len(names))
+	for i := range dbs {
+		dbs[i], _ = NewMemoryKV("")
+	}
+	s, err := NewShardKV(names, dbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dbs
+}
+
+func TestShardKV(t *testing.T) {
+	s, dbs := newTestShards(t, "50]a", "50]b")
+	for i := 0; i < 1000; i++ {
+		s.Set(strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+
+	vs, err := s.MultiGet([]string{"1", "2", "3", "x"})
+	if err != nil || string(vs[0]) != "1" || string(vs[1]) != "2" || string(vs[2]) != "3" || vs[3] != nil {
+		t.Fatal(vs, err)
+	}
+
+	count := func(db KeyValueOp) int {
+		n := 0
+		for cursor := ""; ; {
+			res, next, err := db.Scan("", cursor, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n += len(res)
+			if next == "" {
+				return n
+			}
+			cursor = next
+		}
+	}
+	if a, b := count(dbs[0]), count(dbs[1]); a+b != 1000 || a < 400 || b < 400 || count(s) != 1000 {
+		t.Fatal(a, b)
+	}
+
+	// Add a shard with the same backends
+	c, _ := NewMemoryKV("")
+	s2, err := NewShardKV([]string{"50]a", "50]b", "50]c"}, []KeyValueOp{dbs[0], dbs[1], c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s2.Rebalance(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(r)
+	if r.Moved["50]a -> 50]b"] > 0 || r.Moved["50]b -> 50]a"] > 0 || count(c) < 250 {
+		t.Fatal("keys should only move to the new shard", r, count(c))
+	}
+	for i := 0; i < 1000; i++ {
+		if v, _ := s2.Get(strconv.Itoa(i)); string(v) != strconv.Itoa(i) {
+			t.Fatal(i, string(v))
+		}
+	}
+	if r, _ := s2.Rebalance(true); len(r.Moved) != 0 || r.Scanned != 1000 {
+		t.Fatal(r)
+	}
+}
@@ -0,0 +1,219 @@
+package kv
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/coyove/iis/dal/kv/cache"
+)
+
+const (
+	sqlTable         = "iis_kv"
+	sqlBatchGetLimit = 500
+)
+
+// SQLKV stores everything in one table: (id TEXT PRIMARY KEY, value BLOB, version INT).
+// Drivers are not imported here, see driver_*.go in the main package.
+type SQLKV struct {
+	db       *sql.DB
+	postgres bool
+}
+
+func NewSQLKV(driver, dsn string) (*SQLKV, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &SQLKV{
+		db:       db,
+		postgres: driver == "postgres" || driver == "pgx",
+	}
+
+	schema := "CREATE TABLE IF NOT EXISTS " + sqlTable + " (id TEXT PRIMARY KEY, value BLOB, version INTEGER NOT NULL DEFAULT 0)"
+	if m.postgres {
+		// "C" collation makes range scans match Go's byte-wise string comparison
+		schema = "CREATE TABLE IF NOT EXISTS " + sqlTable + ` (id TEXT COLLATE "C" PRIMARY KEY, value BYTEA, version BIGINT NOT NULL DEFAULT 0)`
+	} else if driver == "sqlite" || driver == "sqlite3" {
+		db.SetMaxOpenConns(1) // SQLite allows only one writer
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// q rewrites '?' placeholders into '$n' for PostgreSQL
+func (m *SQLKV) q(query string) string {
+	if !m.postgres {
+		return query
+	}
+	buf := strings.Builder{}
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+		} else {
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+func (m *SQLKV) SetGlobalCache(c *cache.GlobalCache) {
+	// The database has its own buffer cache
+}
+
+func (m *SQLKV) Get(key string) ([]byte, error) {
+	v, _, err := m.GetWithVersion(key)
+	return v, err
+}
+
+func (m *SQLKV) MultiGet(keys []string) ([][]byte, error) {
+	res := make([][]byte, len(keys))
+	idx := make(map[string][]int, len(keys))
+	for i, k := range keys {
+		idx[k] = append(idx[k], i)
+	}
+
+	for start := 0; start < len(keys); start += sqlBatchGetLimit {
+		batch := keys[start:]
+		if len(batch) > sqlBatchGetLimit {
+			batch = batch[:sqlBatchGetLimit]
+		}
+
+		args := make([]interface{}, len(batch))
+		for i := range batch {
+			args[i] = batch[i]
+		}
+
+		rows, err := m.db.Query(m.q("SELECT id, value FROM "+sqlTable+" WHERE id IN (?"+strings.Repeat(",?", len(batch)-1)+")"), args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var id string
+			var v []byte
+			if err := rows.Scan(&id, &v); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			for _, i := range idx[id] {
+				res[i] = v
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (m *SQLKV) GetWithVersion(key string) ([]byte, uint64, error) {
+	var v []byte
+	var ver int64
+	err := m.db.QueryRow(m.q("SELECT value, version FROM "+sqlTable+" WHERE id = ?"), key).Scan(&v, &ver)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	}
+	return v, uint64(ver), err
+}
+
+func (m *SQLKV) Set(key string, value []byte) error {
+	_, err := m.db.Exec(m.q("INSERT INTO "+sqlTable+" (id, value, version) VALUES (?, ?, 1) "+
+		"ON CONFLICT (id) DO UPDATE SET value = excluded.value, version = "+sqlTable+".version + 1"), key, value)
+	return err
+}
+
+func (m *SQLKV) CompareAndSet(key string, value []byte, ver uint64) error {
+	var res sql.Result
+	var err error
+	if ver == 0 {
+		res, err = m.db.Exec(m.q("INSERT INTO "+sqlTable+" (id, value, version) VALUES (?, ?, 1) ON CONFLICT (id) DO NOTHING"), key, value)
+	} else {
+		res, err = m.db.Exec(m.q("UPDATE "+sqlTable+" SET value = ?, version = version + 1 WHERE id = ? AND version = ?"), value, key, int64(ver))
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (m *SQLKV) Delete(key string) error {
+	_, err := m.db.Exec(m.q("DELETE FROM "+sqlTable+" WHERE id = ?"), key)
+	return err
+}
+
+func (m *SQLKV) CompareAndDelete(key string, ver uint64) error {
+	res, err := m.db.Exec(m.q("DELETE FROM "+sqlTable+" WHERE id = ? AND version = ?"), key, int64(ver))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// Scan returns keys with the given prefix in order, 'cursor' is the last key of the previous page
+func (m *SQLKV) Scan(prefix, cursor string, limit int) ([]Pair, string, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+
+	query, args := "SELECT id, value FROM "+sqlTable+" WHERE id > ? AND id >= ?", []interface{}{cursor, prefix}
+	if end := prefixEnd(prefix); end != "" {
+		query += " AND id < ?"
+		args = append(args, end)
+	}
+	query += " ORDER BY id LIMIT " + strconv.Itoa(limit+1)
+
+	rows, err := m.db.Query(m.q(query), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	res := []Pair{}
+	for rows.Next() {
+		p := Pair{}
+		if err := rows.Scan(&p.Key, &p.Value); err != nil {
+			return nil, "", err
+		}
+		res = append(res, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(res) > limit {
+		res = res[:limit]
+		return res, res[limit-1].Key, nil
+	}
+	return res, "", nil
+}
+
+// prefixEnd returns the smallest string greater than all strings with the prefix, or "" if there is none
+func prefixEnd(prefix string) string {
+	p := []byte(prefix)
+	for i := len(p) - 1; i >= 0; i-- {
+		if p[i] < 0xff {
+			p[i]++
+			return string(p[:i+1])
+		}
+	}
+	return ""
+}
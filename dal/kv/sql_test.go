@@ -0,0 +1,73 @@
+//go:build sqlite
+// +build sqlite
+
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestSQLKV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewSQLKV("sqlite", filepath.Join(dir, "iis.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := m.Set(strconv.Itoa(i), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, _ := m.Get("7"); string(v) != "7" {
+		t.Fatal(v)
+	}
+	if v, err := m.Get("zzz"); v != nil || err != nil {
+		t.Fatal(v, err)
+	}
+
+	_, ver, _ := m.GetWithVersion("7")
+	if err := m.CompareAndSet("7", []byte("x"), ver+1); err != ErrConflict {
+		t.Fatal(err)
+	}
+	if err := m.CompareAndSet("7", []byte("x"), ver); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CompareAndSet("7", []byte("y"), 0); err != ErrConflict {
+		t.Fatal(err)
+	}
+	if err := m.CompareAndSet("new", []byte("y"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := m.MultiGet([]string{"7", "zzz", "new", "7"}); string(res[0]) != "x" || res[1] != nil || string(res[2]) != "y" || string(res[3]) != "x" {
+		t.Fatal(res)
+	}
+
+	if err := m.Delete("12"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("12"); v != nil {
+		t.Fatal(v)
+	}
+
+	// "1", "10", "11", "13" ... "19"
+	res, next, err := m.Scan("1", "", 5)
+	if err != nil || len(res) != 5 || next != "14" || res[0].Key != "1" || res[3].Key != "13" {
+		t.Fatal(res, next, err)
+	}
+	res, next, _ = m.Scan("1", next, 5)
+	if len(res) != 5 || next != "" || res[0].Key != "15" || res[4].Key != "19" {
+		t.Fatal(res, next)
+	}
+}
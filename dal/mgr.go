@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"os"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/coyove/iis/common"
+	"github.com/coyove/iis/common/metrics"
+	"github.com/coyove/iis/dal/cold"
+	"github.com/coyove/iis/dal/feed"
 	"github.com/coyove/iis/dal/kv"
 	"github.com/coyove/iis/dal/kv/cache"
 	"github.com/coyove/iis/ik"
@@ -15,31 +20,204 @@ import (
 )
 
 var m struct {
-	db        KeyValueOp
-	weakUsers *cache.WeakCache
+	db     KeyValueOp
+	hot    KeyValueOp // the backend without the change feed, used by Archive
+	shards *kv.ShardKV
+	mirror *kv.MirrorKV
+	cold   *cold.Store
+	feed   *feed.Feed
+	users  userCache
+}
+
+// userCache keeps users for a second to absorb repeated lookups within a request,
+// it stores and returns copies (PasswordHash included) so callers can't modify cached users.
+type userCache struct {
+	*cache.ShardedCache
+}
+
+func copyUser(u model.User) *model.User {
+	u.PasswordHash = append([]byte(nil), u.PasswordHash...)
+	return &u
+}
+
+func (c userCache) Get(id string) *model.User {
+	v, _ := c.ShardedCache.Get(id)
+	if u, ok := v.(model.User); ok {
+		return copyUser(u)
+	}
+	return nil
+}
+
+func (c userCache) Add(u *model.User) {
+	c.ShardedCache.Add(u.ID, *copyUser(*u))
+}
+
+// registerCacheMetrics exports stats of a local cache as iis_<name>_cache_*
+func registerCacheMetrics(name string, c *cache.ShardedCache) {
+	metrics.NewGaugeFunc("iis_"+name+"_cache_hit_ratio", "Hit ratio of the local "+name+" cache", func() float64 {
+		return c.Stats().HitRatio()
+	})
+	metrics.NewGaugeFunc("iis_"+name+"_cache_evictions", "Items evicted from the full local "+name+" cache", func() float64 {
+		return float64(c.Stats().Evictions)
+	})
+	metrics.NewGaugeFunc("iis_"+name+"_cache_items", "Items in the local "+name+" cache", func() float64 {
+		return float64(c.Len())
+	})
+}
+
+var (
+	walkBreaks      = metrics.NewCounter("iis_walk_breaks_total", "Walks stopped early for being too slow", "walker")
+	backgroundTasks = metrics.NewGauge("iis_background_tasks", "Running fan-out goroutines, e.g. mentions and notifications", "task")
+)
+
+// background tracks goroutines of goBackground, so tests can wait for them before resetting m
+var background sync.WaitGroup
+
+// goBackground runs the fan-out work of a write in its own goroutine
+func goBackground(task string, fn func()) {
+	backgroundTasks.Add(1, task)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		defer backgroundTasks.Add(-1, task)
+		fn()
+	}()
 }
 
 func Init(redisConfig *cache.RedisConfig, region string, ak, sk string) {
 	const CacheSize int64 = 10000
 
 	var db KeyValueOp
+	var err error
+
+	switch {
+	case len(common.Cfg.Shards) > 0:
+		m.shards, err = openShards(common.Cfg.Shards)
+		db = m.shards
+	case common.Cfg.Storage != "":
+		db, err = openKV(common.Cfg.Storage)
+	case region == "":
+		db = kv.NewMetricsKV(kv.NewDiskKV(""), "disk")
+	default:
+		var dy *kv.DynamoKV
+		dy, err = kv.NewDynamoKV(dynamoConfig(region, ak, sk))
+		db = newChunkKV(kv.NewMetricsKV(dy, "dynamo"), kv.DynamoChunkSize)
+	}
+
+	if err != nil {
+		panic(err)
+	}
 
-	if region == "" {
-		db = kv.NewDiskKV()
-	} else {
-		db = kv.NewDynamoKV(region, ak, sk)
+	if common.Cfg.Mirror != "" {
+		secondary, err := openKV(common.Cfg.Mirror)
+		if err != nil {
+			panic(err)
+		}
+		m.mirror = kv.NewMirrorKV(db, secondary, common.Cfg.MirrorShadow)
+		db = m.mirror
+		log.Println("[mgr.Init] Mirroring writes to", common.Cfg.Mirror)
+	}
+
+	var pubs []feed.Publisher
+	if common.Cfg.FeedLog != "" {
+		open := feed.OpenLog
+		if ReadOnly {
+			open = feed.OpenLogReadOnly
+		}
+		l, err := open(common.Cfg.FeedLog)
+		if err != nil {
+			panic(err)
+		}
+		pubs = append(pubs, l)
+		closers = append(closers, l)
+	}
+	m.feed = feed.New(pubs...)
+	m.hot = db
+	db = &feedKV{KeyValueOp: db, feed: m.feed}
+
+	if common.Cfg.ColdDir != "" {
+		if m.cold, err = cold.Open(common.Cfg.ColdDir); err != nil {
+			panic(err)
+		}
+	}
+
+	if fault := common.Cfg.StorageFault; fault != "" || os.Getenv("KV_FAULT") != "" {
+		if env := os.Getenv("KV_FAULT"); env != "" {
+			fault = env
+		}
+		cfg, err := kv.ParseFaultConfig(fault)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("[mgr.Init] Fault injection enabled: %+v", cfg)
+		db = kv.NewFaultKV(db, cfg)
 	}
 
 	db.SetGlobalCache(cache.NewGlobalCache(CacheSize, redisConfig))
 
 	m.db = db
-	m.weakUsers = cache.NewWeakCache(65536, time.Second)
+	m.users = userCache{cache.NewShardedCache(65536, time.Second, 32)}
+	registerCacheMetrics("user", m.users.ShardedCache)
+
+	// Reads rely on migrated data (e.g. following lists are read from their roots only), nothing is served before
+	if ReadOnly {
+		if pending, _ := PendingMigrations(); len(pending) > 0 {
+			log.Println("[mgr.Init] Pending migrations:", pending, "opened read-only, they are not applied")
+		}
+	} else if err := Migrate(); err != nil {
+		panic(err)
+	}
+}
+
+// StartBackfill runs Backfill in the background if MirrorBackfill is set, it is called by the server only,
+// commands use 'iis backfill' instead
+func StartBackfill() {
+	if m.mirror != nil && common.Cfg.MirrorBackfill {
+		goBackground("backfill", func() {
+			r, err := m.mirror.Backfill(false, time.Second)
+			log.Printf("[StartBackfill] %+v, error: %v", *r, err)
+		})
+	}
+}
+
+// Close flushes and closes the storage files on shutdown: the change feed log, LogKV and MemoryKV snapshots.
+// Writes fail afterwards, the process is expected to exit.
+func Close() error {
+	var err error
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err2 := closers[i].Close(); err == nil {
+			err = err2
+		}
+	}
+	closers = nil
+	return err
 }
 
 func ModKV() KeyValueOp {
 	return m.db
 }
 
+// Rebalance moves keys to the shards they belong to after the layout in Shards has changed
+func Rebalance(dry bool) (*kv.RebalanceReport, error) {
+	if m.shards == nil {
+		return nil, fmt.Errorf("storage is not sharded")
+	}
+	return m.shards.Rebalance(dry)
+}
+
+// Backfill copies keys from the primary backend to the Mirror one, see kv.MirrorKV
+func Backfill(overwrite bool) (*kv.BackfillReport, error) {
+	if m.mirror == nil {
+		return nil, fmt.Errorf("Mirror is not set")
+	}
+	return m.mirror.Backfill(overwrite, 0)
+}
+
+// Feed returns the change feed of every write going through dal
+func Feed() *feed.Feed {
+	return m.feed
+}
+
 func GetArticle(id string) (*model.Article, error) {
 	if id == "" {
 		return nil, fmt.Errorf("empty ID")
@@ -48,6 +226,11 @@ func GetArticle(id string) (*model.Article, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(p) == 0 {
+		if p, err = getCold(id); err != nil {
+			return nil, err
+		}
+	}
 	if len(p) == 0 {
 		return nil, model.ErrNotExisted
 	}
@@ -67,6 +250,60 @@ func GetArticle(id string) (*model.Article, error) {
 	return a2, nil
 }
 
+// GetArticles fetches multiple articles in one batch, results are in the same order as ids,
+// articles which don't exist or fail to unmarshal will be nil
+func GetArticles(ids ...string) ([]*model.Article, error) {
+	res := make([]*model.Article, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+
+	ps, err := m.db.MultiGet(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, refIdx := []string{}, []int{}
+	for i, p := range ps {
+		if len(p) == 0 {
+			if p, err = getCold(ids[i]); err != nil {
+				return nil, err
+			}
+		}
+		if len(p) == 0 {
+			continue
+		}
+		a, err := model.UnmarshalArticle(p)
+		if err != nil {
+			log.Println("[mgr.GetArticles]", ids[i], err)
+			continue
+		}
+		res[i] = a
+		if a.ReferID != "" {
+			refs, refIdx = append(refs, a.ReferID), append(refIdx, i)
+		}
+	}
+
+	if len(refs) == 0 {
+		return res, nil
+	}
+
+	referred, err := GetArticles(refs...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, a2 := range referred {
+		a := res[refIdx[i]]
+		if a2 != nil {
+			a2.NextID = a.NextID
+			a2.NextMediaID = a.NextMediaID
+		}
+		res[refIdx[i]] = a2
+	}
+	return res, nil
+}
+
 func WalkMulti(media bool, n int, cursors ...ik.ID) (a []*model.Article, next []ik.ID) {
 	if len(cursors) == 0 {
 		return
@@ -75,10 +312,12 @@ func WalkMulti(media bool, n int, cursors ...ik.ID) (a []*model.Article, next []
 	startTime := time.Now()
 	idm := map[string]bool{}
 	idmp := map[string]bool{} // dedup map for parent articles
+	prefetched := map[ik.ID]*model.Article{}
 
 	for len(a) < n {
 		if time.Since(startTime).Seconds() > 1 {
 			log.Println("[mgr.WalkMulti] Break out slow walk at", cursors)
+			walkBreaks.Inc("WalkMulti")
 			break
 		}
 
@@ -109,8 +348,30 @@ func WalkMulti(media bool, n int, cursors ...ik.ID) (a []*model.Article, next []
 			break
 		}
 
-		p, err := GetArticle(latest.String())
-		if err == nil {
+		if _, ok := prefetched[*latest]; !ok {
+			// Fetch the next article of every cursor in one batch
+			ids, keys := []string{}, []ik.ID{}
+			for _, c := range cursors {
+				if _, ok := prefetched[c]; !ok && c.Valid() {
+					ids, keys = append(ids, c.String()), append(keys, c)
+				}
+			}
+
+			res, err := GetArticles(ids...)
+			if err != nil {
+				log.Println("[mgr.WalkMulti] Failed to get:", ids, err)
+				break
+			}
+
+			for i, p := range res {
+				prefetched[keys[i]] = p
+			}
+		}
+
+		p := prefetched[*latest]
+		delete(prefetched, *latest)
+
+		if p != nil {
 			ok := !idm[p.ID] && p.Content != model.DeletionMarker && !latest.IsRoot()
 			// 1. 'p' is not duplicated
 			// 2. 'p' is not deleted
@@ -132,10 +393,6 @@ func WalkMulti(media bool, n int, cursors ...ik.ID) (a []*model.Article, next []
 			}
 			*latest = ik.ParseID(p.PickNextID(media))
 		} else {
-			if err != model.ErrNotExisted {
-				log.Println("[mgr.WalkMulti] Failed to get:", latest.String(), err)
-			}
-
 			*latest = ik.ID{}
 		}
 	}
@@ -149,6 +406,7 @@ func WalkReply(n int, cursor string) (a []*model.Article, next string) {
 	for len(a) < n && cursor != "" {
 		if time.Since(startTime).Seconds() > 1 {
 			log.Println("[mgr.WalkReply] Break out slow walk at", cursor)
+			walkBreaks.Inc("WalkReply")
 			break
 		}
 
@@ -168,31 +426,56 @@ func WalkReply(n int, cursor string) (a []*model.Article, next string) {
 }
 
 func WalkLikes(media bool, n int, cursor string) (a []*model.Article, next string) {
-	startTime := time.Now()
+	startTime, stopped := time.Now(), false
+
+	for len(a) < n && cursor != "" && !stopped {
+		// Like records are walked then their articles are fetched in one batch,
+		// more batches are needed when some articles are gone
+		likes, batchStart := []*model.Article{}, cursor
+		for len(a)+len(likes) < n && cursor != "" {
+			if time.Since(startTime).Seconds() > 1 {
+				log.Println("[mgr.WalkLikes] Break out slow walk at", cursor)
+				walkBreaks.Inc("WalkLikes")
+				stopped = true
+				break
+			}
 
-	for len(a) < n && cursor != "" {
-		if time.Since(startTime).Seconds() > 1 {
-			log.Println("[mgr.WalkLikes] Break out slow walk at", cursor)
+			p, err := GetArticle(cursor)
+			if err != nil {
+				log.Println("[mgr.WalkLikes] Failed to get:", cursor, err)
+				stopped = true
+				break
+			}
+
+			if p.Extras["like"] == "true" {
+				likes = append(likes, p)
+			}
+
+			cursor = p.PickNextID(media)
+		}
+		if len(likes) == 0 {
 			break
 		}
 
-		p, err := GetArticle(cursor)
+		ids := make([]string, len(likes))
+		for i, p := range likes {
+			ids[i] = p.Extras["to"]
+		}
+
+		res, err := GetArticles(ids...)
 		if err != nil {
-			log.Println("[mgr.WalkLikes] Failed to get:", cursor, err)
-			break
+			log.Println("[mgr.WalkLikes] Failed to get:", ids, err)
+			return a, batchStart
 		}
 
-		if p.Extras["like"] == "true" {
-			a2, err := GetArticle(p.Extras["to"])
-			if err == nil {
-				a2.NextID = p.NextID
-				a = append(a, a2)
-			} else {
-				log.Println("[mgr.WalkLikes] Failed to get:", p.Extras["to"], err)
+		for i, a2 := range res {
+			if a2 == nil {
+				log.Println("[mgr.WalkLikes] Failed to get:", ids[i])
+				continue
 			}
+			a2.NextID = likes[i].NextID
+			a = append(a, a2)
 		}
-
-		cursor = p.PickNextID(media)
 	}
 
 	return a, cursor
@@ -210,7 +493,7 @@ func Post(a *model.Article, author *model.User, noMaster bool) (*model.Article,
 		return nil, err
 	}
 
-	go func() {
+	goBackground("post", func() {
 		if !noMaster {
 			Do(NewRequest("InsertArticle",
 				"RootID", ik.NewID(ik.IDAuthor, "master").String(),
@@ -224,7 +507,7 @@ func Post(a *model.Article, author *model.User, noMaster bool) (*model.Article,
 		}
 		ids, tags := common.ExtractMentionsAndTags(a.Content)
 		MentionUserAndTags(a, ids, tags)
-	}()
+	})
 
 	return a, nil
 }
@@ -270,7 +553,7 @@ func PostReply(parent string, content, media string, author *model.User, ip stri
 		}
 	}
 
-	go func() {
+	goBackground("reply", func() {
 		if p.Content != model.DeletionMarker && a.Author != p.Author {
 			if err := Do(NewRequest(DoInsertArticle,
 				"RootID", ik.NewID(ik.IDInbox, p.Author).String(),
@@ -290,7 +573,7 @@ func PostReply(parent string, content, media string, author *model.User, ip stri
 		}
 		ids, tags := common.ExtractMentionsAndTags(a.Content)
 		MentionUserAndTags(a, ids, tags)
-	}()
+	})
 
 	return a, nil
 }
@@ -0,0 +1,302 @@
+package dal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coyove/iis/common"
+	"github.com/coyove/iis/dal/kv"
+	"github.com/coyove/iis/ik"
+	"github.com/coyove/iis/model"
+)
+
+const migrationPrefix = "migration/"
+
+// Migration is a one-shot schema change. It must be idempotent:
+// if the process crashes before the marker is written, it will run again.
+type Migration struct {
+	Name string
+	Run  func() error
+}
+
+// Migrations run in this order, never reorder or rename them, only append
+var migrations = []Migration{
+	{"0001-following-chain", migrateFollowingChain},
+	{"0002-binary-codec", MigrateBinaryCodec},
+}
+
+// PendingMigrations returns the names of migrations which haven't been done
+func PendingMigrations() ([]string, error) {
+	res := []string{}
+	for _, mg := range migrations {
+		p, err := m.db.Get(migrationPrefix + mg.Name)
+		if err != nil {
+			return nil, err
+		}
+		if len(p) == 0 {
+			res = append(res, mg.Name)
+		}
+	}
+	return res, nil
+}
+
+// Migrate runs pending migrations in order and records each of them in "migration/<name>",
+// it stops at the first failure so later migrations can rely on earlier ones.
+func Migrate() error {
+	for _, mg := range migrations {
+		key := migrationPrefix + mg.Name
+		p, err := m.db.Get(key)
+		if err != nil {
+			return err
+		}
+		if len(p) > 0 {
+			continue
+		}
+
+		st := time.Now()
+		log.Println("[Migrate]", mg.Name, "started")
+		if err := mg.Run(); err != nil {
+			log.Println("[Migrate]", mg.Name, "failed:", err)
+			return err
+		}
+		if err := m.db.Set(key, []byte(time.Now().Format(time.RFC3339))); err != nil {
+			return err
+		}
+		log.Println("[Migrate]", mg.Name, "done in", time.Since(st))
+	}
+	return nil
+}
+
+// scanAll calls 'fn' for every key with the prefix
+func scanAll(prefix string, fn func(p kv.Pair) error) error {
+	for cursor := ""; ; {
+		res, next, err := m.db.Scan(prefix, cursor, 1000)
+		if err != nil {
+			return err
+		}
+		for _, p := range res {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func isUserKey(key string) bool {
+	return strings.HasPrefix(key, "u/") && strings.Count(key, "/") == 1
+}
+
+// migrateFollowingChain moves the deprecated User.FollowingChain into the IDFollowing root
+func migrateFollowingChain() error {
+	count := 0
+	err := scanAll("u/", func(p kv.Pair) error {
+		if !isUserKey(p.Key) {
+			return nil
+		}
+		u, err := model.UnmarshalUser(p.Value)
+		if err != nil {
+			log.Println("[Migrate] bad user:", p.Key, err)
+			return nil
+		}
+		if u.FollowingChain == "" {
+			return nil
+		}
+
+		if err := migrateUserFollowingChain(u); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	log.Println("[Migrate] following chain:", count, "users migrated")
+	return err
+}
+
+func migrateUserFollowingChain(u *model.User) error {
+	rootID := ik.NewID(ik.IDFollowing, u.ID).String()
+
+	// Legacy chains start with articles, the first "u/" record is where the follow records begin
+	next, visited := u.FollowingChain, map[string]bool{}
+	for next != "" && !strings.HasPrefix(next, "u/") {
+		if visited[next] {
+			log.Println("[Migrate]", u.ID, "following chain has a cycle at", next)
+			next = ""
+			break
+		}
+		visited[next] = true
+
+		a, err := GetArticle(next)
+		if err == model.ErrNotExisted {
+			log.Println("[Migrate]", u.ID, "following chain broken at", next)
+			next = ""
+			break
+		}
+		if err != nil {
+			return err
+		}
+		next = a.NextID
+	}
+
+	p, err := m.db.Get(rootID)
+	if err != nil {
+		return err
+	}
+
+	if len(p) > 0 {
+		// Users who followed someone after the chain was deprecated already have the root
+		if err := spliceFollowRecords(u.ID, rootID, next); err != nil {
+			return err
+		}
+	} else {
+		if next == "" {
+			keys, err := followRecordKeys(u.ID, nil)
+			if err != nil {
+				return err
+			}
+			if next, err = linkFollowRecords(u.ID, keys); err != nil {
+				return err
+			}
+		}
+		// A conflict means the user has just followed someone, the next run will splice the records
+		root := &model.Article{ID: rootID, NextID: next, CreateTime: time.Now()}
+		if err := m.db.CompareAndSet(rootID, root.Marshal(), 0); err != nil {
+			return err
+		}
+	}
+
+	return Do(NewRequest(DoUpdateUser, "ID", u.ID, "ClearFollowingChain", true))
+}
+
+// spliceFollowRecords appends the records missing in the existing root chain to its tail: the legacy chain
+// starting at 'next', or all follow records not in the chain if the legacy one is broken. New records are
+// inserted after the root, so the tail only changes here.
+func spliceFollowRecords(id, rootID, next string) error {
+	tail, inChain := rootID, map[string]bool{rootID: true}
+	for {
+		a, err := GetArticle(tail)
+		if err != nil {
+			return err
+		}
+		if a.NextID == "" {
+			break
+		}
+		if inChain[a.NextID] {
+			return fmt.Errorf("following chain of %s has a cycle at %s, run 'iis fsck -repair' first", id, a.NextID)
+		}
+		inChain[a.NextID] = true
+		tail = a.NextID
+	}
+
+	if next == "" {
+		keys, err := followRecordKeys(id, inChain)
+		if err != nil {
+			return err
+		}
+		if next, err = linkFollowRecords(id, keys); err != nil {
+			return err
+		}
+	}
+	if next == "" || inChain[next] {
+		// Nothing to splice, or spliced by a previous run
+		return nil
+	}
+
+	common.LockKey(tail)
+	defer common.UnlockKey(tail)
+
+	a, ver, err := getArticleForUpdate(tail)
+	if err != nil {
+		return err
+	}
+	if a.NextID != "" {
+		return fmt.Errorf("following chain of %s has changed at %s, run again", id, tail)
+	}
+	a.NextID = next
+	if err := m.db.CompareAndSet(a.ID, a.Marshal(), ver); err != nil {
+		return err
+	}
+	log.Println("[Migrate]", id, "spliced", next, "after", tail)
+	return nil
+}
+
+// followRecordKeys returns the sorted keys of follow records of the user, except those in 'skip'
+func followRecordKeys(id string, skip map[string]bool) ([]string, error) {
+	keys := []string{}
+	if err := scanAll("u/"+id+"/follow/", func(p kv.Pair) error {
+		if !skip[p.Key] {
+			keys = append(keys, p.Key)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// linkFollowRecords recovers a broken chain by linking the records in key order, it returns the first one
+func linkFollowRecords(id string, keys []string) (string, error) {
+	next := ""
+	for i := len(keys) - 1; i >= 0; i-- {
+		a, ver, err := getArticleForUpdate(keys[i])
+		if err != nil {
+			return "", err
+		}
+		a.NextID = next
+		if err := m.db.CompareAndSet(a.ID, a.Marshal(), ver); err != nil {
+			return "", err
+		}
+		next = a.ID
+	}
+	if len(keys) > 0 {
+		log.Println("[Migrate]", id, "relinked", len(keys), "follow records")
+	}
+	return next, nil
+}
+
+// MigrateBinaryCodec rewrites articles and users still stored in JSON with the binary codec.
+// Values are re-encoded when they are written anyway, this converts the rest at once. It is safe to run it again.
+func MigrateBinaryCodec() error {
+	count := 0
+	err := scanAll("", func(p kv.Pair) error {
+		if len(p.Value) == 0 || p.Value[0] != '{' {
+			return nil
+		}
+
+		v, ver, err := m.db.GetWithVersion(p.Key)
+		if err != nil {
+			return err
+		}
+
+		var buf []byte
+		if isUserKey(p.Key) {
+			u, err := model.UnmarshalUser(v)
+			if err != nil {
+				return nil
+			}
+			buf = u.Marshal()
+		} else if a, err := model.UnmarshalArticle(v); err == nil && a.ID == p.Key {
+			buf = a.Marshal()
+		} else {
+			return nil
+		}
+
+		// A concurrent write has already re-encoded the value
+		if err := m.db.CompareAndSet(p.Key, buf, ver); err != nil && err != kv.ErrConflict {
+			return err
+		}
+		if count++; count%10000 == 0 {
+			log.Println("[MigrateBinaryCodec]", count, "values rewritten")
+		}
+		return nil
+	})
+	log.Println("[MigrateBinaryCodec]", count, "values rewritten")
+	return err
+}
@@ -0,0 +1,165 @@
+package dal
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coyove/iis/common"
+	"github.com/coyove/iis/dal/kv"
+)
+
+// openKV creates a storage backend from its spec: "engine[:arg][;option=value...]"
+//
+//	disk[:dir]        one file per key under the directory, default: tmp/data
+//	log[:path]        single-file append-only log, default path: tmp/iis.db
+//	memory[:snapshot] in-memory map, optionally saved to the snapshot file every minute and on shutdown
+//	redis[:addr[/db]] Redis as the primary store, default addr: RedisAddr
+//	sql:driver:dsn    database/sql, e.g. sql:sqlite:tmp/iis.sqlite, the driver must be built in (see driver_*.go)
+//	dynamo[:table]    DynamoDB, configured by Dy* in config.yml, default table: DyTable
+//
+// Options:
+//
+//	compress=N        compress values larger than N bytes, e.g. dynamo;compress=1024
+//	chunk=N           split values larger than N bytes into several keys, dynamo uses kv.DynamoChunkSize by default
+func openKV(spec string) (KeyValueOp, error) {
+	opts := strings.Split(spec, ";")
+	db, err := openBackend(opts[0])
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := db.(io.Closer); ok {
+		closers = append(closers, c)
+	}
+	engine := strings.SplitN(opts[0], ":", 2)[0]
+	db = kv.NewMetricsKV(db, engine)
+	if engine == "dynamo" && !strings.Contains(spec, ";chunk=") {
+		opts = append(opts, "chunk="+strconv.Itoa(kv.DynamoChunkSize))
+	}
+
+	for _, opt := range opts[1:] {
+		p := strings.SplitN(opt, "=", 2)
+		if len(p) != 2 {
+			return nil, fmt.Errorf("invalid storage option: %q", opt)
+		}
+
+		switch p[0] {
+		case "compress":
+			n, err := strconv.Atoi(p[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid storage option: %q", opt)
+			}
+			db = kv.NewCompressKV(db, n)
+		case "chunk":
+			n, err := strconv.Atoi(p[1])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid storage option: %q", opt)
+			}
+			db = newChunkKV(db, n)
+		default:
+			return nil, fmt.Errorf("unknown storage option: %q", opt)
+		}
+	}
+	return db, nil
+}
+
+// closers are the backends (and the feed log) with files to flush on shutdown, see Close
+var closers []io.Closer
+
+// chunkKVs are all ChunkKVs opened, which may be inside shards or mirrors, see VacuumChunks
+var chunkKVs []*kv.ChunkKV
+
+func newChunkKV(db KeyValueOp, size int) KeyValueOp {
+	c := kv.NewChunkKV(db, size)
+	chunkKVs = append(chunkKVs, c)
+	return c
+}
+
+// VacuumChunks deletes chunks left by crashed or concurrent writes, see kv.ChunkKV
+func VacuumChunks() (scanned, deleted int, err error) {
+	for _, c := range chunkKVs {
+		s, d, err := c.Vacuum(time.Hour)
+		scanned, deleted = scanned+s, deleted+d
+		if err != nil {
+			return scanned, deleted, err
+		}
+	}
+	return scanned, deleted, nil
+}
+
+// ReadOnly is set before Init by commands which only read, so they can run next to the server
+// which owns the storage files, e.g. LogKV is opened without the lock, truncation and compaction
+var ReadOnly bool
+
+func openBackend(spec string) (KeyValueOp, error) {
+	engine, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		engine, arg = spec[:i], spec[i+1:]
+	}
+
+	switch engine {
+	case "disk":
+		return kv.NewDiskKV(arg), nil
+	case "log":
+		if ReadOnly {
+			return kv.OpenLogKVReadOnly(arg)
+		}
+		return kv.NewLogKV(arg)
+	case "memory":
+		return kv.NewMemoryKV(arg)
+	case "redis":
+		if arg == "" {
+			arg = common.Cfg.RedisAddr
+		}
+		return kv.NewRedisKV(arg, common.Cfg.RedisVolatile)
+	case "sql":
+		p := strings.SplitN(arg, ":", 2)
+		if len(p) != 2 {
+			return nil, fmt.Errorf("invalid sql storage: %q, should be sql:driver:dsn", spec)
+		}
+		return kv.NewSQLKV(p[0], p[1])
+	case "dynamo":
+		c := dynamoConfig(common.Cfg.DyRegion, common.Cfg.DyAccessKey, common.Cfg.DySecretKey)
+		if arg != "" {
+			c.Table = arg
+		}
+		return kv.NewDynamoKV(c)
+	default:
+		return nil, fmt.Errorf("unknown storage engine: %q", spec)
+	}
+}
+
+func dynamoConfig(region, ak, sk string) kv.DynamoConfig {
+	return kv.DynamoConfig{
+		Region:      region,
+		AccessKey:   ak,
+		SecretKey:   sk,
+		Table:       common.Cfg.DyTable,
+		Endpoint:    common.Cfg.DyEndpoint,
+		Timeout:     time.Duration(common.Cfg.DyTimeout) * time.Millisecond,
+		MaxConns:    common.Cfg.DyMaxConns,
+		Retries:     common.Cfg.DyRetries,
+		CreateTable: common.Cfg.DyCreateTable,
+	}
+}
+
+// openShards opens backends of "NN]name=spec" entries, NN is the weight. Keys are placed by the name,
+// so the spec (e.g. options or credentials in a DSN) can change without moving keys, see kv.ShardKV
+func openShards(specs []string) (*kv.ShardKV, error) {
+	names, dbs := make([]string, len(specs)), make([]KeyValueOp, len(specs))
+	for i, spec := range specs {
+		eq := strings.Index(spec, "=")
+		if len(spec) < 4 || spec[2] != ']' || spec[0] < '0' || spec[0] > '9' || spec[1] < '0' || spec[1] > '9' ||
+			eq < 4 || strings.ContainsAny(spec[3:eq], ":;") {
+			return nil, fmt.Errorf("invalid shard: %q, should be NN]name=spec, e.g. 50]a=disk:tmp/data1", spec)
+		}
+		db, err := openKV(spec[eq+1:])
+		if err != nil {
+			return nil, err
+		}
+		names[i], dbs[i] = spec[:eq], db
+	}
+	return kv.NewShardKV(names, dbs)
+}
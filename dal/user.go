@@ -9,7 +9,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-	"unsafe"
 
 	"github.com/coyove/iis/common"
 	"github.com/coyove/iis/ik"
@@ -21,8 +20,8 @@ func GetUser(id string) (*model.User, error) {
 	if id == "" {
 		return nil, fmt.Errorf("empty user id")
 	}
-	if u := m.weakUsers.Get(id); u != nil {
-		return (*model.User)(u), nil
+	if u := m.users.Get(id); u != nil {
+		return u, nil
 	}
 
 	p, err := m.db.Get("u/" + id)
@@ -36,32 +35,7 @@ func GetUser(id string) (*model.User, error) {
 
 	u, err := model.UnmarshalUser(p)
 	if u != nil {
-		u2 := *u
-		m.weakUsers.Add(u.ID, unsafe.Pointer(&u2))
-		if u.FollowingChain != "" {
-			go func() {
-				fc, _ := GetArticle(u.FollowingChain)
-				id := ik.NewID(ik.IDFollowing, u.ID).String()
-				if fc != nil {
-					for !strings.HasPrefix(fc.NextID, "u/") {
-						fc2, _ := GetArticle(fc.NextID)
-						if fc2 != nil {
-							fc = fc2
-						} else {
-							log.Println(u.ID, "following chain broken")
-							break
-						}
-					}
-					a := &model.Article{
-						ID:     id,
-						NextID: fc.NextID,
-					}
-					if _, err := GetArticle(a.ID); err == model.ErrNotExisted {
-						m.db.Set(a.ID, a.Marshal())
-					}
-				}
-			}()
-		}
+		m.users.Add(u)
 	}
 
 	return u, err
@@ -171,12 +145,12 @@ func FollowUser(from, to string, following bool) (E error) {
 			return
 		}
 
-		go func() {
+		goBackground("follow", func() {
 			Do(NewRequest(DoUpdateUser, "ID", from, "IncDecFollowings", following))
 			if !strings.HasPrefix(to, "#") {
 				fromFollowToNotifyTo(from, to, following)
 			}
-		}()
+		})
 	}()
 
 	r := NewRequest(DoUpdateArticle,
@@ -248,7 +222,7 @@ func LikeArticle(from, to string, liking bool) (E error) {
 		return err
 	}
 	if updated {
-		go func() {
+		goBackground("like", func() {
 			r := NewRequest(DoUpdateArticle, "ID", to, "IncDecLikes", liking)
 			if err := Do(r); err == nil {
 				// if the author followed 'from', notify the author that his articles has been liked by 'from'
@@ -268,11 +242,13 @@ func LikeArticle(from, to string, liking bool) (E error) {
 				}
 			}
 
-		}()
+		})
 	}
 	return nil
 }
 
+// insertChainOrUpdate records are never deleted, unfollowing etc. sets the state to false because
+// the record is a node of the chain
 func insertChainOrUpdate(aid, chainid string, to string, cmd model.Cmd, value bool) (updated bool, E error) {
 	state := strconv.FormatBool(value)
 	r := NewRequest(DoUpdateArticle, "ID", aid, "SetExtraKey", string(cmd), "SetExtraValue", state)
@@ -329,6 +305,7 @@ func GetFollowingList(chain ik.ID, cursor string, n int) ([]FollowingState, stri
 	for len(res) < n && strings.HasPrefix(cursor, "u/") {
 		if time.Since(start).Seconds() > 0.2 {
 			log.Println("[GetFollowingList] Break out slow walk [", cursor, "]")
+			walkBreaks.Inc("GetFollowingList")
 			break
 		}
 
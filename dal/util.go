@@ -7,7 +7,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/coyove/iis/dal/kv/cache"
+	"github.com/coyove/iis/dal/kv"
 	"github.com/gin-gonic/gin"
 )
 
@@ -15,11 +15,7 @@ var (
 	rxCrawler = regexp.MustCompile(`(?i)(bot|googlebot|crawler|spider|robot|crawling)`)
 )
 
-type KeyValueOp interface {
-	Get(string) ([]byte, error)
-	Set(string, []byte) error
-	SetGlobalCache(*cache.GlobalCache)
-}
+type KeyValueOp = kv.KeyValueOp
 
 func IsCrawler(g *gin.Context) bool {
 	if rxCrawler.MatchString(g.Request.UserAgent()) {
@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// PostgreSQL driver for "Storage: sql:postgres:postgres://...", build with: go build -tags postgres
+import _ "github.com/lib/pq"
@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// Pure Go SQLite driver for "Storage: sql:sqlite:tmp/iis.sqlite", build with: go build -tags sqlite
+import _ "modernc.org/sqlite"
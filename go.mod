@@ -3,11 +3,17 @@ module github.com/coyove/iis
 go 1.13
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20180125190556-5a6b3ba71ee6 // indirect
+	github.com/alicebob/miniredis v2.5.0+incompatible
 	github.com/aws/aws-sdk-go v1.28.2
 	github.com/coyove/common v0.0.0-20191227065653-969f6d26239a
 	github.com/gin-gonic/gin v1.5.0
 	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-isatty v0.0.13 // indirect
 	github.com/o1egl/govatar v0.3.0
-	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa // indirect
+	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb // indirect
+	golang.org/x/sys v0.7.0 // indirect
 	gopkg.in/yaml.v2 v2.2.7
+	modernc.org/sqlite v1.10.0
 )
@@ -11,12 +11,20 @@ import (
 	"github.com/coyove/common/lru"
 	"github.com/coyove/iis/common"
 	"github.com/coyove/iis/ik/captcha"
-	"github.com/coyove/iis/model"
 	"github.com/gin-gonic/gin"
 )
 
 var Dedup = lru.NewCache(1024)
 
+// userID returns the ID of the logged in user, ik can't import model because model encodes IDs using ik.ID
+func userID(g *gin.Context) (string, bool) {
+	u, _ := g.Get("user")
+	if u, ok := u.(interface{ GetID() string }); ok {
+		return u.GetID(), true
+	}
+	return "", false
+}
+
 func MakeToken(g *gin.Context) (string, string) {
 	var x [4]byte
 	uuid := MakeUUID(g, &x)
@@ -28,11 +36,10 @@ func MakeUUID(g *gin.Context, x *[4]byte) string {
 	exp := time.Now().Add(time.Minute * time.Duration(common.Cfg.TokenTTL)).Unix()
 	binary.BigEndian.PutUint32(p[:], uint32(exp))
 
-	u, _ := g.Get("user")
-	if u == nil {
-		copy(p[4:10], g.Request.UserAgent())
+	if id, ok := userID(g); ok {
+		copy(p[4:10], id)
 	} else {
-		copy(p[4:10], u.(*model.User).ID)
+		copy(p[4:10], g.Request.UserAgent())
 	}
 	rand.Read(p[10:])
 
@@ -58,9 +65,8 @@ func ParseToken(g *gin.Context, tok string) (r []byte, ok bool) {
 
 	tmp := [6]byte{}
 
-	u, _ := g.Get("user")
-	if u != nil {
-		copy(tmp[:], u.(*model.User).ID)
+	if id, ok := userID(g); ok {
+		copy(tmp[:], id)
 	} else {
 		copy(tmp[:], g.Request.UserAgent())
 	}
@@ -115,17 +121,13 @@ func ParseToken(g *gin.Context, tok string) (r []byte, ok bool) {
 // 	return string(p)
 // }
 
-func MakeUserToken(u *model.User) string {
-	if u == nil {
-		return ""
-	}
-
-	length := len(u.ID) + 1 + len(u.Session)
+func MakeUserToken(id, session string) string {
+	length := len(id) + 1 + len(session)
 	length = (length + 7) / 8 * 8
 
 	x := make([]byte, length)
-	copy(x, u.Session)
-	copy(x[len(u.Session)+1:], u.ID)
+	copy(x, session)
+	copy(x[len(session)+1:], id)
 
 	for i := 0; i <= len(x)-16; i += 8 {
 		common.Cfg.Blk.Encrypt(x[i:], x[i:])
@@ -5,7 +5,7 @@ import (
 	"strconv"
 	"testing"
 
-	"github.com/coyove/iis/model"
+	"github.com/coyove/iis/common"
 )
 
 func TestID(t *testing.T) {
@@ -14,7 +14,7 @@ func TestID(t *testing.T) {
 	return
 
 	for i := 0; i < 1e6; i++ {
-		tag := model.SafeStringForCompressString(strconv.Itoa(rand.Int()))
+		tag := common.SafeStringForCompressString(strconv.Itoa(rand.Int()))
 
 		id := NewID(IDAuthor,tag)
 		if rand.Intn(2) == 0 {
@@ -6,10 +6,12 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/coyove/iis/action"
@@ -33,10 +35,31 @@ func main() {
 
 	common.MustLoadConfig()
 
+	dal.ReadOnly = flag.NArg() > 0 && readOnlyCommand(flag.Args())
 	dal.Init(&cache.RedisConfig{
 		Addr: common.Cfg.RedisAddr,
 	}, common.Cfg.DyRegion, common.Cfg.DyAccessKey, common.Cfg.DySecretKey)
 
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		log.Println("[main] shutting down:", <-c)
+		if err := dal.Close(); err != nil {
+			log.Println("[main] close storage:", err)
+		}
+		os.Exit(0)
+	}()
+
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		if err := dal.Close(); err != nil {
+			log.Fatal("[main] close storage: ", err)
+		}
+		return
+	}
+
+	dal.StartBackfill()
+
 	if os.Getenv("BENCH") == "1" {
 		ids := []string{}
 		names := []string{"aa", "bb", "cc", "dd"}
@@ -141,6 +164,7 @@ func main() {
 	r.Handle("GET", "/avatar/:id", view.Avatar)
 	r.Handle("GET", "/mod/user", view.ModUser)
 	r.Handle("GET", "/mod/kv", view.ModKV)
+	r.Handle("GET", "/metrics", view.Metrics)
 
 	r.Handle("POST", "/api/p/:parent", view.APIReplies)
 	r.Handle("POST", "/api/timeline", view.APITimeline)
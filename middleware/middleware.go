@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -48,6 +49,13 @@ func mwRenderPerf(g *gin.Context) {
 	g.Next()
 	msec := time.Since(start).Nanoseconds() / 1e6
 
+	route := g.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	httpDuration.Since(start, route, g.Request.Method)
+	httpRequests.Inc(route, g.Request.Method, strconv.Itoa(g.Writer.Status()))
+
 	if msec > Survey.Max {
 		Survey.Max = msec
 	}
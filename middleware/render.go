@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/coyove/iis/common/metrics"
 	"github.com/gin-gonic/gin"
 )
 
@@ -17,6 +18,11 @@ var Survey struct {
 	Written int64
 }
 
+var (
+	httpDuration = metrics.NewHistogram("iis_http_request_duration_seconds", "Latency of HTTP requests by route", metrics.DefBuckets, "route", "method")
+	httpRequests = metrics.NewCounter("iis_http_requests_total", "HTTP requests by route and status", "route", "method", "status")
+)
+
 var engine *gin.Engine
 
 func loadTrafficCounter() {
@@ -0,0 +1,386 @@
+package model
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coyove/iis/ik"
+)
+
+// Binary values start with: 0xfe | kind | codec version, 0xfe never appears in JSON (legacy values)
+// and differs from the compression magic (0xff). Fields follow as: tag | length | payload,
+// zero fields are omitted and unknown tags are skipped, so adding fields doesn't need a new version.
+// Legacy JSON values are still readable and get rewritten in binary the next time they are saved.
+const (
+	codecMagic   = 0xfe
+	codecArticle = 'A'
+	codecUser    = 'U'
+	codecVersion = 1
+)
+
+const (
+	_ = iota
+	tagArticleID
+	tagArticleReplies
+	tagArticleLikes
+	tagArticleLocked
+	tagArticleAlone
+	tagArticleNSFW
+	tagArticleContent
+	tagArticleMedia
+	tagArticleAuthor
+	tagArticleIP
+	tagArticleCreateTime
+	tagArticleParent
+	tagArticleReplyChain
+	tagArticleNextReplyID
+	tagArticleNextMediaID
+	tagArticleNextID
+	tagArticleEOC
+	tagArticleCmd
+	tagArticleExtras
+	tagArticleReferID
+)
+
+const (
+	_ = iota
+	tagUserID
+	tagUserSession
+	tagUserRole
+	tagUserPasswordHash
+	tagUserEmail
+	tagUserAvatar
+	tagUserCustomName
+	tagUserFollowers
+	tagUserFollowings
+	tagUserUnread
+	tagUserFollowingChain
+	tagUserDataIP
+	tagUserTSignup
+	tagUserTLogin
+	tagUserBanned
+	tagUserKimochi
+)
+
+type encoder struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func newEncoder(kind byte) *encoder {
+	return &encoder{buf: []byte{codecMagic, kind, codecVersion}}
+}
+
+func (e *encoder) field(tag int, p []byte) {
+	e.buf = append(e.buf, e.tmp[:binary.PutUvarint(e.tmp[:], uint64(tag))]...)
+	e.buf = append(e.buf, e.tmp[:binary.PutUvarint(e.tmp[:], uint64(len(p)))]...)
+	e.buf = append(e.buf, p...)
+}
+
+func (e *encoder) bytes(tag int, p []byte) {
+	if len(p) > 0 {
+		e.field(tag, p)
+	}
+}
+
+func (e *encoder) string(tag int, s string) {
+	if s != "" {
+		e.field(tag, []byte(s))
+	}
+}
+
+// id writes the binary form of ik.ID, the first byte of which is never 0,
+// strings which are not valid IDs are written as 0 + raw string
+func (e *encoder) id(tag int, s string) {
+	if s == "" {
+		return
+	}
+	if id := ik.ParseID(s); id.Valid() && id.String() == s {
+		e.field(tag, id.Marshal(nil))
+	} else {
+		e.field(tag, append([]byte{0}, s...))
+	}
+}
+
+func (e *encoder) uint(tag int, v uint64) {
+	if v != 0 {
+		var p [binary.MaxVarintLen64]byte
+		e.field(tag, p[:binary.PutUvarint(p[:], v)])
+	}
+}
+
+func (e *encoder) int(tag int, v int64) {
+	if v != 0 {
+		var p [binary.MaxVarintLen64]byte
+		e.field(tag, p[:binary.PutVarint(p[:], v)])
+	}
+}
+
+func (e *encoder) bool(tag int, v bool) {
+	if v {
+		e.field(tag, nil)
+	}
+}
+
+func (e *encoder) time(tag int, t time.Time) {
+	if !t.IsZero() {
+		e.int(tag, t.UnixNano())
+	}
+}
+
+func (e *encoder) strmap(tag int, m map[string]string) {
+	if len(m) == 0 {
+		return
+	}
+	x := encoder{}
+	for k, v := range m {
+		x.buf = append(x.buf, x.tmp[:binary.PutUvarint(x.tmp[:], uint64(len(k)))]...)
+		x.buf = append(x.buf, k...)
+		x.buf = append(x.buf, x.tmp[:binary.PutUvarint(x.tmp[:], uint64(len(v)))]...)
+		x.buf = append(x.buf, v...)
+	}
+	e.field(tag, x.buf)
+}
+
+func isBinary(b []byte, kind byte) bool {
+	return len(b) >= 3 && b[0] == codecMagic && b[1] == kind
+}
+
+// decodeFields calls 'fn' for every field in 'b', which has already been checked by isBinary
+func decodeFields(b []byte, fn func(tag uint64, p []byte) error) error {
+	if b[2] > codecVersion {
+		return fmt.Errorf("unknown codec version: %d", b[2])
+	}
+
+	for b = b[3:]; len(b) > 0; {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid field tag")
+		}
+		b = b[n:]
+
+		ln, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < ln {
+			return fmt.Errorf("invalid field %d", tag)
+		}
+		p := b[n : n+int(ln)]
+		b = b[n+int(ln):]
+
+		if err := fn(tag, p); err != nil {
+			return fmt.Errorf("field %d: %v", tag, err)
+		}
+	}
+	return nil
+}
+
+func decodeID(p []byte) string {
+	if len(p) > 0 && p[0] == 0 {
+		return string(p[1:])
+	}
+	return ik.UnmarshalID(p).String()
+}
+
+func decodeUint(p []byte) (uint64, error) {
+	v, n := binary.Uvarint(p)
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid uvarint")
+	}
+	return v, nil
+}
+
+func decodeInt(p []byte) (int64, error) {
+	v, n := binary.Varint(p)
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid varint")
+	}
+	return v, nil
+}
+
+func decodeStrmap(p []byte) (map[string]string, error) {
+	m := map[string]string{}
+	for len(p) > 0 {
+		var kv [2]string
+		for i := range kv {
+			ln, n := binary.Uvarint(p)
+			if n <= 0 || uint64(len(p)-n) < ln {
+				return nil, fmt.Errorf("invalid map")
+			}
+			kv[i] = string(p[n : n+int(ln)])
+			p = p[n+int(ln):]
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+func (a *Article) marshalBinary() []byte {
+	e := newEncoder(codecArticle)
+	e.id(tagArticleID, a.ID)
+	e.int(tagArticleReplies, int64(a.Replies))
+	e.int(tagArticleLikes, int64(a.Likes))
+	e.bool(tagArticleLocked, a.Locked)
+	e.bool(tagArticleAlone, a.Alone)
+	e.bool(tagArticleNSFW, a.NSFW)
+	e.string(tagArticleContent, a.Content)
+	e.string(tagArticleMedia, a.Media)
+	e.string(tagArticleAuthor, a.Author)
+	e.string(tagArticleIP, a.IP)
+	e.time(tagArticleCreateTime, a.CreateTime)
+	e.id(tagArticleParent, a.Parent)
+	e.id(tagArticleReplyChain, a.ReplyChain)
+	e.id(tagArticleNextReplyID, a.NextReplyID)
+	e.id(tagArticleNextMediaID, a.NextMediaID)
+	e.id(tagArticleNextID, a.NextID)
+	e.id(tagArticleEOC, a.EOC)
+	e.string(tagArticleCmd, string(a.Cmd))
+	e.strmap(tagArticleExtras, a.Extras)
+	e.id(tagArticleReferID, a.ReferID)
+	return e.buf
+}
+
+func (a *Article) unmarshalBinary(b []byte) error {
+	return decodeFields(b, func(tag uint64, p []byte) (err error) {
+		var i int64
+		switch tag {
+		case tagArticleID:
+			a.ID = decodeID(p)
+		case tagArticleReplies:
+			i, err = decodeInt(p)
+			a.Replies = int(i)
+		case tagArticleLikes:
+			i, err = decodeInt(p)
+			a.Likes = int32(i)
+		case tagArticleLocked:
+			a.Locked = true
+		case tagArticleAlone:
+			a.Alone = true
+		case tagArticleNSFW:
+			a.NSFW = true
+		case tagArticleContent:
+			a.Content = string(p)
+		case tagArticleMedia:
+			a.Media = string(p)
+		case tagArticleAuthor:
+			a.Author = string(p)
+		case tagArticleIP:
+			a.IP = string(p)
+		case tagArticleCreateTime:
+			i, err = decodeInt(p)
+			a.CreateTime = time.Unix(0, i)
+		case tagArticleParent:
+			a.Parent = decodeID(p)
+		case tagArticleReplyChain:
+			a.ReplyChain = decodeID(p)
+		case tagArticleNextReplyID:
+			a.NextReplyID = decodeID(p)
+		case tagArticleNextMediaID:
+			a.NextMediaID = decodeID(p)
+		case tagArticleNextID:
+			a.NextID = decodeID(p)
+		case tagArticleEOC:
+			a.EOC = decodeID(p)
+		case tagArticleCmd:
+			a.Cmd = Cmd(p)
+		case tagArticleExtras:
+			a.Extras, err = decodeStrmap(p)
+		case tagArticleReferID:
+			a.ReferID = decodeID(p)
+		}
+		return
+	})
+}
+
+func (u *User) marshalBinary() []byte {
+	e := newEncoder(codecUser)
+	e.string(tagUserID, u.ID)
+	e.string(tagUserSession, u.Session)
+	e.string(tagUserRole, u.Role)
+	e.bytes(tagUserPasswordHash, u.PasswordHash)
+	e.string(tagUserEmail, u.Email)
+	e.uint(tagUserAvatar, uint64(u.Avatar))
+	e.string(tagUserCustomName, u.CustomName)
+	e.int(tagUserFollowers, int64(u.Followers))
+	e.int(tagUserFollowings, int64(u.Followings))
+	e.int(tagUserUnread, int64(u.Unread))
+	e.id(tagUserFollowingChain, u.FollowingChain)
+	e.string(tagUserDataIP, u.DataIP)
+	e.uint(tagUserTSignup, uint64(u.TSignup))
+	e.uint(tagUserTLogin, uint64(u.TLogin))
+	e.bool(tagUserBanned, u.Banned)
+	e.uint(tagUserKimochi, uint64(u.Kimochi))
+	return e.buf
+}
+
+func (u *User) unmarshalBinary(b []byte) error {
+	return decodeFields(b, func(tag uint64, p []byte) (err error) {
+		var i int64
+		var x uint64
+		switch tag {
+		case tagUserID:
+			u.ID = string(p)
+		case tagUserSession:
+			u.Session = string(p)
+		case tagUserRole:
+			u.Role = string(p)
+		case tagUserPasswordHash:
+			u.PasswordHash = append([]byte{}, p...)
+		case tagUserEmail:
+			u.Email = string(p)
+		case tagUserAvatar:
+			x, err = decodeUint(p)
+			u.Avatar = uint32(x)
+		case tagUserCustomName:
+			u.CustomName = string(p)
+		case tagUserFollowers:
+			i, err = decodeInt(p)
+			u.Followers = int32(i)
+		case tagUserFollowings:
+			i, err = decodeInt(p)
+			u.Followings = int32(i)
+		case tagUserUnread:
+			i, err = decodeInt(p)
+			u.Unread = int32(i)
+		case tagUserFollowingChain:
+			u.FollowingChain = decodeID(p)
+		case tagUserDataIP:
+			u.DataIP = string(p)
+		case tagUserTSignup:
+			x, err = decodeUint(p)
+			u.TSignup = uint32(x)
+		case tagUserTLogin:
+			x, err = decodeUint(p)
+			u.TLogin = uint32(x)
+		case tagUserBanned:
+			u.Banned = true
+		case tagUserKimochi:
+			x, err = decodeUint(p)
+			u.Kimochi = byte(x)
+		}
+		return
+	})
+}
+
+// ToJSON converts binary articles and users into JSON for the admin UI, other values are returned as is
+func ToJSON(b []byte) []byte {
+	var v interface{}
+	switch {
+	case isBinary(b, codecArticle):
+		a := &Article{}
+		if a.unmarshalBinary(b) != nil {
+			return b
+		}
+		v = a
+	case isBinary(b, codecUser):
+		u := &User{}
+		if u.unmarshalBinary(b) != nil {
+			return b
+		}
+		v = u
+	default:
+		return b
+	}
+	p, _ := json.Marshal(v)
+	return p
+}
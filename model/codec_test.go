@@ -0,0 +1,73 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coyove/iis/ik"
+)
+
+func TestCodec(t *testing.T) {
+	a := &Article{
+		ID:          ik.NewGeneralID().String(),
+		Replies:     12,
+		Likes:       -1,
+		NSFW:        true,
+		Content:     "hello 世界",
+		Author:      "zzz",
+		CreateTime:  time.Unix(0, time.Now().UnixNano()),
+		Parent:      ik.NewGeneralID().String(),
+		NextReplyID: "not an id",
+		NextID:      ik.NewID(ik.IDAuthor, "zzz").String(),
+		Cmd:         CmdReply,
+		Extras:      map[string]string{"a": "1", "": ""},
+	}
+
+	buf := a.Marshal()
+	js, _ := json.Marshal(a)
+	t.Log("binary:", len(buf), "json:", len(js))
+
+	for _, p := range [][]byte{buf, js} {
+		a2, err := UnmarshalArticle(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !a2.CreateTime.Equal(a.CreateTime) {
+			t.Fatal(a2.CreateTime, a.CreateTime)
+		}
+		a2.CreateTime = a.CreateTime
+		if !reflect.DeepEqual(a, a2) {
+			t.Fatal(a, a2)
+		}
+	}
+
+	u := User{
+		ID:           "zzz",
+		PasswordHash: []byte{0, 1, 2},
+		Avatar:       1 << 31,
+		Followers:    3,
+		TSignup:      uint32(time.Now().Unix()),
+		Banned:       true,
+		Kimochi:      7,
+	}
+
+	js, _ = json.Marshal(u)
+	for _, p := range [][]byte{u.Marshal(), js} {
+		u2, err := UnmarshalUser(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&u, u2) {
+			t.Fatal(u, u2)
+		}
+	}
+
+	if _, err := UnmarshalArticle(buf[:len(buf)-1]); err == nil {
+		t.Fatal("truncated value")
+	}
+	if string(ToJSON(u.Marshal())) != string(js) {
+		t.Fatal(string(ToJSON(u.Marshal())))
+	}
+}
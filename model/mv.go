@@ -68,13 +68,17 @@ func (a *Article) PickNextID(media bool) string {
 }
 
 func (a *Article) Marshal() []byte {
-	b, _ := json.Marshal(a)
-	return b
+	return a.marshalBinary()
 }
 
 func UnmarshalArticle(b []byte) (*Article, error) {
 	a := &Article{}
-	err := json.Unmarshal(b, a)
+	var err error
+	if isBinary(b, codecArticle) {
+		err = a.unmarshalBinary(b)
+	} else {
+		err = json.Unmarshal(b, a)
+	}
 	if a.ID == "" {
 		return nil, fmt.Errorf("failed to unmarshal: %q", b)
 	}
@@ -106,10 +110,11 @@ type User struct {
 }
 
 func (u User) Marshal() []byte {
-	b, _ := json.Marshal(u)
-	return b
+	return u.marshalBinary()
 }
 
+func (u User) GetID() string { return u.ID }
+
 func (u User) DisplayName() string {
 	if u.CustomName == "" {
 		return "@" + u.ID
@@ -157,7 +162,12 @@ func (u User) IDHash() (hash uint64) {
 
 func UnmarshalUser(b []byte) (*User, error) {
 	a := &User{}
-	err := json.Unmarshal(b, a)
+	var err error
+	if isBinary(b, codecUser) {
+		err = a.unmarshalBinary(b)
+	} else {
+		err = json.Unmarshal(b, a)
+	}
 	if a.ID == "" {
 		return nil, fmt.Errorf("failed to unmarshal: %q", b)
 	}
@@ -1,8 +1,14 @@
 package view
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
+	"net"
 
+	"github.com/coyove/iis/common"
+	"github.com/coyove/iis/common/metrics"
 	"github.com/coyove/iis/dal"
 	"github.com/coyove/iis/ik"
 	"github.com/coyove/iis/model"
@@ -30,7 +36,7 @@ func ModUser(g *gin.Context) {
 	}
 
 	if g.Query("swap") == "1" && p.You.IsAdmin() {
-		g.SetCookie("id", ik.MakeUserToken(p.User), 86400, "", "", false, false)
+		g.SetCookie("id", ik.MakeUserToken(p.User.ID, p.User.Session), 86400, "", "", false, false)
 	}
 
 	getter := func(h ik.IDHeader) string {
@@ -56,12 +62,24 @@ func ModUser(g *gin.Context) {
 }
 
 func ModKV(g *gin.Context) {
+	type item struct {
+		Key   string
+		Value string
+	}
+
 	p := struct {
-		You *model.User
-		Key string
+		You    *model.User
+		Key    string
+		Prefix string
+		Cursor string
+		Next   string
+		Error  string
+		Items  []item
 	}{
-		You: getUser(g),
-		Key: g.Query("key"),
+		You:    getUser(g),
+		Key:    g.Query("key"),
+		Prefix: g.Query("prefix"),
+		Cursor: g.Query("cursor"),
 	}
 
 	if p.You == nil || !p.You.IsAdmin() {
@@ -69,5 +87,39 @@ func ModKV(g *gin.Context) {
 		return
 	}
 
+	if p.Prefix != "" || g.Query("list") == "1" {
+		res, next, err := dal.ModKV().Scan(p.Prefix, p.Cursor, 50)
+		if err != nil {
+			p.Error = err.Error()
+		}
+		for _, r := range res {
+			buf := bytes.Buffer{}
+			if json.Indent(&buf, model.ToJSON(r.Value), "", "  ") != nil {
+				buf.Reset()
+				buf.Write(r.Value)
+			}
+			p.Items = append(p.Items, item{r.Key, buf.String()})
+		}
+		p.Next = next
+	}
+
 	g.HTML(200, "mod_kv.html", p)
 }
+
+// Metrics serves Prometheus metrics to loopback, or to anyone with ?key=MetricsKey.
+// Loopback is checked on the connection, requests forwarded by a local proxy need the key too.
+func Metrics(g *gin.Context) {
+	host, _, _ := net.SplitHostPort(g.Request.RemoteAddr)
+	ip, key := net.ParseIP(host), common.Cfg.MetricsKey
+	proxied := g.GetHeader("X-Forwarded-For") != "" || g.GetHeader("X-Real-IP") != ""
+	if ip == nil || !ip.IsLoopback() || proxied {
+		if key == "" || subtle.ConstantTimeCompare([]byte(g.Query("key")), []byte(key)) != 1 {
+			g.AbortWithStatus(403)
+			return
+		}
+	}
+
+	g.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	g.Status(200)
+	metrics.Write(g.Writer)
+}
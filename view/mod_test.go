@@ -0,0 +1,40 @@
+package view
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coyove/iis/common"
+	"github.com/gin-gonic/gin"
+)
+
+func TestMetricsLoopback(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	common.Cfg.MetricsKey = "k"
+	defer func() { common.Cfg.MetricsKey = "" }()
+
+	get := func(remote, url string, header ...string) int {
+		w := httptest.NewRecorder()
+		g, _ := gin.CreateTestContext(w)
+		g.Request = httptest.NewRequest("GET", url, nil)
+		g.Request.RemoteAddr = remote
+		for i := 0; i < len(header); i += 2 {
+			g.Request.Header.Set(header[i], header[i+1])
+		}
+		Metrics(g)
+		return w.Code
+	}
+
+	if c := get("127.0.0.1:1234", "/metrics"); c != 200 {
+		t.Fatal(c)
+	}
+	if c := get("10.0.0.1:1234", "/metrics", "X-Forwarded-For", "127.0.0.1"); c != 403 {
+		t.Fatal("spoofed X-Forwarded-For:", c)
+	}
+	if c := get("127.0.0.1:1234", "/metrics", "X-Forwarded-For", "10.0.0.1"); c != 403 {
+		t.Fatal("forwarded by a local proxy:", c)
+	}
+	if c := get("10.0.0.1:1234", "/metrics?key=k"); c != 200 {
+		t.Fatal(c)
+	}
+}